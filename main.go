@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 	"wolfy/server"
+	"wolfy/service"
 	"wolfy/service/bilibili"
 )
 
@@ -23,7 +30,50 @@ func main() {
 	anchorCode := os.Getenv("ANCHOR_CODE")
 	appIDStr := os.Getenv("APP_ID")
 	songPackage := os.Getenv("SONG_PACKAGE_PATH")
+	// SONG_PACKAGE_PATH 可以有多个游戏数据目录, 以系统路径分隔符分隔, 后面的目录优先
+	// SONG_SOURCE 为 package 时读取游戏数据目录, 为 json 时读取 SONG_JSON_PATH,
+	// 为 lxns 或 diving-fish 时从 SONG_SOURCE_URL 导入, 默认有游戏数据时使用 package
+	songSourceKind := os.Getenv("SONG_SOURCE")
+	songSourcePath := songPackage
+	if songSourceKind == "" {
+		songSourceKind = service.SongSourcePackage
+		if songPackage == "" {
+			songSourceKind = service.SongSourceJSON
+		}
+	}
+	switch songSourceKind {
+	case service.SongSourceJSON:
+		songSourcePath = os.Getenv("SONG_JSON_PATH")
+		if songSourcePath == "" {
+			songSourcePath = "./static/maimai/songs.json"
+		}
+	case service.SongSourceLxns, service.SongSourceDivingFish:
+		songSourcePath = os.Getenv("SONG_SOURCE_URL")
+	}
+	songSource, err := service.NewSongSource(songSourceKind, songSourcePath)
+	if err != nil {
+		panic(err)
+	}
+	if remote, ok := songSource.(*service.RemoteSongSource); ok {
+		remote.MaxAge = envDuration("SONG_CACHE_MAX_AGE")
+	}
 	aliasFile := os.Getenv("ALIAS_FILE_PATH")
+	policy := service.TicketPolicy{
+		PaidMinBattery:       int64(envInt("PAID_MIN_BATTERY")),
+		PaidExceedLimit:      envBool("PAID_EXCEED_LIMIT"),
+		MaxActivePerViewer:   envInt("MAX_ACTIVE_PER_VIEWER"),
+		PickCooldown:         envDuration("PICK_COOLDOWN"),
+		DailyQuota:           envInt("DAILY_QUOTA"),
+		ExemptGuardLevel:     envInt("EXEMPT_GUARD_LEVEL"),
+		ExemptFansMedalLevel: envInt("EXEMPT_FANS_MEDAL_LEVEL"),
+		ExemptAdmin:          envBool("EXEMPT_ADMIN"),
+		RedirectDuplicate:    envBool("REDIRECT_DUPLICATE"),
+		ReplayCooldown:       envDuration("REPLAY_COOLDOWN"),
+		MinMatchScore:        envInt("MIN_MATCH_SCORE"),
+		DisambiguationWindow: envDuration("DISAMBIGUATION_WINDOW"),
+		AllowUtage:           envBool("ALLOW_UTAGE"),
+		AllowLocked:          envBool("ALLOW_LOCKED"),
+	}
 
 	appID, err := strconv.Atoi(appIDStr)
 	if err != nil {
@@ -40,10 +90,67 @@ func main() {
 		anchorCode,
 		signatory,
 	)
-	bilibiliChan := bilibiliApp.Spin()
+	ctx, stop := signal.NotifyContext(context.Background(),
+		syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	bilibiliChan := bilibiliApp.Spin(ctx)
 	if bilibiliChan == nil {
 		panic(fmt.Errorf("bilibiliApp.Spin() returned nil"))
 	}
-	s := server.NewLocalServer(songPackage, aliasFile, bilibiliChan)
-	s.Spin()
+	access := server.AccessConfig{
+		AnchorToken: os.Getenv("ANCHOR_TOKEN"),
+		Moderators:  strings.Split(os.Getenv("MODERATORS"), ","),
+	}
+	s := server.NewLocalServer(songSource, aliasFile, policy, access, bilibiliChan)
+	// JACKET_DIR 已经导出为图片的封面目录, 多个目录以系统路径分隔符分隔;
+	// 游戏数据中的封面是 .ab 资源包, 需要先用其他工具导出为 png/jpg/webp
+	jacketDirs := filepath.SplitList(os.Getenv("JACKET_DIR"))
+	if len(jacketDirs) > 0 {
+		s.Jackets = service.NewJacketStore(jacketDirs, service.DefaultJacketCacheDir)
+	}
+	if os.Getenv("ALIAS_REFRESH_INTERVAL") != "" {
+		s.AliasRefreshInterval = envDuration("ALIAS_REFRESH_INTERVAL")
+	}
+	s.Spin(ctx)
+}
+
+func envInt(key string) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil {
+		panic(fmt.Errorf("invalid %s: %v", key, err))
+	}
+	return result
+}
+
+func envBool(key string) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return false
+	}
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		panic(fmt.Errorf("invalid %s: %v", key, err))
+	}
+	return result
+}
+
+// envDuration 支持 30s、5m 等格式, 纯数字按秒处理
+func envDuration(key string) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	result, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Errorf("invalid %s: %v", key, err))
+	}
+	return result
 }
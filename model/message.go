@@ -101,3 +101,10 @@ func (m *MessageManager) ForEachMessage(fn func(message *Message)) {
 		}
 	}
 }
+
+// Flush 将当前消息写入检查点, 退出前调用
+func (m *MessageManager) Flush() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.saveCheckPoint()
+}
@@ -0,0 +1,83 @@
+package model
+
+import (
+	"strings"
+	"sync"
+)
+
+// Role 观众在直播间中的角色, 数值越大权限越高
+type Role int
+
+const (
+	RoleViewer Role = iota
+	// RoleModerator 配置的管理员名单
+	RoleModerator
+	// RoleAdmin 房管
+	RoleAdmin
+	// RoleAnchor 主播
+	RoleAnchor
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleModerator:
+		return "moderator"
+	case RoleAdmin:
+		return "admin"
+	case RoleAnchor:
+		return "anchor"
+	}
+	return "viewer"
+}
+
+// Permissions 根据主播 open_id、房管标记与管理员名单确定观众的角色
+type Permissions struct {
+	lock         sync.RWMutex
+	anchorOpenID string
+	anchorName   string
+	moderators   map[string]bool
+}
+
+// NewPermissions moderators 为管理员的 open_id, 也可以写 uid:<uid>
+func NewPermissions(moderators []string) *Permissions {
+	p := &Permissions{moderators: map[string]bool{}}
+	for _, moderator := range moderators {
+		moderator = strings.TrimSpace(moderator)
+		if moderator != "" {
+			p.moderators[moderator] = true
+		}
+	}
+	return p
+}
+
+// SetAnchor 记录主播的 open_id 与昵称, 开启场次后由 /v2/app/start 返回
+func (p *Permissions) SetAnchor(openID string, name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.anchorOpenID = openID
+	p.anchorName = name
+}
+
+// AnchorName 主播昵称, 还没有开启场次时为空
+func (p *Permissions) AnchorName() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.anchorName
+}
+
+// Resolve 设置观众的角色, 已经是主播的不会降级
+func (p *Permissions) Resolve(viewer *Viewer) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	switch {
+	case viewer.Role == RoleAnchor:
+	case viewer.OpenID != "" && viewer.OpenID == p.anchorOpenID:
+		viewer.Role = RoleAnchor
+	case viewer.IsAdmin:
+		viewer.Role = RoleAdmin
+	case p.moderators[viewer.ID()] || (viewer.UID != 0 && p.moderators[uidKey(viewer.UID)]):
+		viewer.Role = RoleModerator
+	default:
+		viewer.Role = RoleViewer
+	}
+}
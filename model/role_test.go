@@ -0,0 +1,27 @@
+package model
+
+import "testing"
+
+func Test_PermissionsResolve(t *testing.T) {
+	p := NewPermissions([]string{"open-mod", " uid:42 "})
+	p.SetAnchor("open-anchor", "主播")
+
+	for _, c := range []struct {
+		viewer Viewer
+		want   Role
+	}{
+		{Viewer{OpenID: "open-anchor", Name: "随便什么名字"}, RoleAnchor},
+		{Viewer{OpenID: "open-x", Name: "主播"}, RoleViewer},
+		{Viewer{OpenID: "open-y", IsAdmin: true}, RoleAdmin},
+		{Viewer{OpenID: "open-mod"}, RoleModerator},
+		{Viewer{OpenID: "open-z", UID: 42}, RoleModerator},
+		{Viewer{Name: "本地", Role: RoleAnchor}, RoleAnchor},
+		{Viewer{OpenID: "open-w", Role: RoleModerator}, RoleViewer},
+	} {
+		viewer := c.viewer
+		p.Resolve(&viewer)
+		if viewer.Role != c.want {
+			t.Fatalf("%+v: got role %s, want %s", c.viewer, viewer.Role, c.want)
+		}
+	}
+}
@@ -5,6 +5,29 @@ const (
 	CommandFinish    = "finish"
 	CommandNextLevel = "next_level"
 	CommandNextRank  = "next_rank"
+	// 歌单管理, 需要主播、房管或管理员权限
+	CommandMove        = "move"
+	CommandSwap        = "swap"
+	CommandPin         = "pin"
+	CommandClear       = "clear"
+	CommandClearViewer = "clear_viewer"
+	// CommandAlias 提交别名, Content 为 "<歌曲id或标题> <别名>";
+	// 房管也可以用 "待审"、"通过 <申请id>"、"拒绝 <申请id>" 审核
+	CommandAlias = "alias"
+	// CommandRandom 随机点歌, Content 为分类、谱面类型、难度与等级条件, 可以为空
+	CommandRandom = "random"
+	// CommandSearch 查看关键词的候选歌曲, Content 为关键词
+	CommandSearch = "search"
+	// CommandChat 非指令弹幕
+	CommandChat = "chat"
+
+	CommandGift           = "gift"
+	CommandSuperChat      = "super_chat"
+	CommandGuard          = "guard"
+	CommandLike           = "like"
+	CommandInteractionEnd = "interaction_end"
+	// CommandSessionStart 开启场次, Content 为场次id, Viewer 为主播
+	CommandSessionStart = "session_start"
 )
 
 type Task struct {
@@ -12,4 +35,20 @@ type Task struct {
 	Caller  string `json:"caller"`
 	Content string `json:"content"`
 	Index   int64  `json:"index"`
+	// Target 移动的目标位置或交换的另一首
+	Target int64 `json:"target"`
+	// Price 礼物、付费留言、大航海的总价值, 单位为电池
+	Price int64 `json:"price"`
+	// Count 礼物、大航海、点赞的数量
+	Count int64 `json:"count"`
+	// Viewer 发起任务的观众, 为空时只有 Caller
+	Viewer *Viewer `json:"viewer,omitempty"`
+}
+
+// GetViewer 返回发起任务的观众, 没有详细信息时以 Caller 构造
+func (t *Task) GetViewer() *Viewer {
+	if t.Viewer == nil {
+		t.Viewer = &Viewer{Name: t.Caller}
+	}
+	return t.Viewer
 }
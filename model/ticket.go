@@ -1,11 +1,19 @@
 package model
 
 type ITicketMaster interface {
-	AddTicket(creator string, keyword string) (string, error)
-	FinishTicket(operator string, index int64) (string, error)
+	AddTicket(creator *Viewer, keyword string) (string, error)
+	AddPaidTicket(creator *Viewer, keyword string, price int64) (string, error)
+	AddRandomTicket(creator *Viewer, filters string) (string, error)
+	FinishTicket(operator *Viewer, index int64) (string, error)
 	ForEachTicket(fn func(ITicket))
-	NextLevel(operator string, index int64) (string, error)
-	NextRank(operator string, index int64) (string, error)
+	NextLevel(operator *Viewer, index int64) (string, error)
+	NextRank(operator *Viewer, index int64) (string, error)
+	MoveTicket(operator *Viewer, from int64, to int64) (string, error)
+	SwapTickets(operator *Viewer, a int64, b int64) (string, error)
+	PinTicket(operator *Viewer, index int64) (string, error)
+	ClearTickets(operator *Viewer) (string, error)
+	ClearViewerTickets(operator *Viewer, index int64) (string, error)
+	Flush() error
 }
 
 type ITicket interface {
@@ -13,8 +21,18 @@ type ITicket interface {
 	GetKeyword() string
 	GetCreator() string
 	GetCoverPath() string
+	GetSongID() int
+	GetPrice() int64
+	IsPinned() bool
 
 	GetCoverInfo() string
 	GetGenreInfo() string
 	GetSongInfo() string
+
+	// 歌曲与当前谱面的信息, 曲库没有时为零值
+	GetArtist() string
+	GetBPM() int
+	GetVersion() string
+	GetCharter() string
+	GetNotes() int
 }
@@ -0,0 +1,39 @@
+package model
+
+import "strconv"
+
+// Viewer 发起任务的观众, 弹幕与礼物中带有大航海、粉丝牌和房管信息
+type Viewer struct {
+	// OpenID 开放平台下观众的唯一标识, 不随昵称变化
+	OpenID         string `json:"open_id"`
+	UID            int64  `json:"uid"`
+	Name           string `json:"name"`
+	GuardLevel     int    `json:"guard_level"` // 1总督 2提督 3舰长, 0 表示无
+	FansMedalLevel int    `json:"fans_medal_level"`
+	IsAdmin        bool   `json:"is_admin"`
+	// Role 由 Permissions 根据主播 open_id、房管与管理员名单设置, 弹幕昵称无法冒充
+	Role Role `json:"role"`
+}
+
+// Elevated 主播、房管与管理员可以操作任何人的点歌
+func (v *Viewer) Elevated() bool {
+	return v.Role >= RoleModerator
+}
+
+// ID 观众的稳定标识, 优先使用 open_id
+func (v *Viewer) ID() string {
+	if v.OpenID != "" {
+		return v.OpenID
+	}
+	if v.UID != 0 {
+		return uidKey(v.UID)
+	}
+	if v.Role == RoleAnchor {
+		return "anchor"
+	}
+	return "name:" + v.Name
+}
+
+func uidKey(uid int64) string {
+	return "uid:" + strconv.FormatInt(uid, 10)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	AnchorTokenHeader = "X-Anchor-Token"
+	AnchorTokenQuery  = "token"
+	AnchorTokenCookie = "wolfy_anchor_token"
+)
+
+// AccessConfig 权限配置
+type AccessConfig struct {
+	// AnchorToken 本地控制台的主播令牌, 为空时启动时随机生成并打印
+	AnchorToken string
+	// Moderators 管理员的 open_id, 也可以写 uid:<uid>
+	Moderators []string
+}
+
+func (a *AccessConfig) ensureToken() {
+	if a.AnchorToken != "" {
+		return
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	a.AnchorToken = hex.EncodeToString(buf)
+	log.Printf("ANCHOR_TOKEN not set, open http://localhost:41377/api/login?%s=%s to authorize this browser",
+		AnchorTokenQuery, a.AnchorToken)
+}
+
+// anchorToken 依次从请求头、参数与 cookie 中读取令牌, 跨站请求不读取 cookie
+func anchorToken(c *gin.Context) string {
+	if token := c.GetHeader(AnchorTokenHeader); token != "" {
+		return token
+	}
+	if token := c.Query(AnchorTokenQuery); token != "" {
+		return token
+	}
+	if crossSite(c) {
+		return ""
+	}
+	if token, err := c.Cookie(AnchorTokenCookie); err == nil {
+		return token
+	}
+	return ""
+}
+
+// crossSite 浏览器标明请求来自其他网站, 这时不使用 cookie, 避免其他网页通过链接操作歌单;
+// localhost 不同端口的开发服务器属于同站, 仍然可以使用
+func crossSite(c *gin.Context) bool {
+	return c.GetHeader("Sec-Fetch-Site") == "cross-site"
+}
+
+// localOrigin 只允许本机的控制台与 OBS 浮窗跨域访问, 如开发服务器 http://localhost:3000
+func localOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
+
+func (l *LocalServer) isAnchor(c *gin.Context) bool {
+	token := anchorToken(c)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(l.access.AnchorToken)) == 1
+}
+
+// RequireAnchor 只允许持有主播令牌的请求
+func (l *LocalServer) RequireAnchor(c *gin.Context) {
+	if !l.isAnchor(c) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"msg": "需要主播令牌"})
+		return
+	}
+	c.Next()
+}
+
+// Login 校验令牌后写入 cookie, 之后浏览器中的控制台无需再带令牌;
+// 控制台的操作都是 GET 请求, cookie 只在同站请求中发送
+func (l *LocalServer) Login(c *gin.Context) {
+	if !l.isAnchor(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"msg": "令牌错误"})
+		return
+	}
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(AnchorTokenCookie, anchorToken(c), 365*24*3600, "/", "", false, true)
+	redirect := c.Query("redirect")
+	if redirect == "" || !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = "/static/index.html"
+	}
+	c.Redirect(http.StatusFound, redirect)
+}
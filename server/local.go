@@ -1,47 +1,91 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"log"
+	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"wolfy/model"
 	"wolfy/service"
+	"wolfy/service/bilibili"
 )
 
 type LocalServer struct {
 	TicketMaster   model.ITicketMaster
 	MessageManager *model.MessageManager
-	router         *gin.Engine
+	History        *service.History
+	Aliases        *service.AliasModerator
+	// AliasRefreshInterval 在线别名的刷新间隔, 0 表示不刷新
+	AliasRefreshInterval time.Duration
+	// Jackets 本地封面, 为 nil 时使用曲库中的封面地址
+	Jackets *service.JacketStore
+	router  *gin.Engine
+	storage *service.MaimaiStorage
 
 	taskChan chan *model.Task
+	taskDone chan struct{}
+
+	// lastDanmu 观众最近一条弹幕, 礼物点歌时作为歌名, 只保留 lastDanmuTTL 内的
+	lastDanmuLock sync.Mutex
+	lastDanmu     map[string]recentDanmu
+
+	access      AccessConfig
+	permissions *model.Permissions
 }
 
-func NewLocalServer(songDB string, aliasPath string, taskChan chan *model.Task) *LocalServer {
+func NewLocalServer(source service.SongSource, aliasPath string, policy service.TicketPolicy, access AccessConfig,
+	taskChan chan *model.Task) *LocalServer {
 
 	localTicketsCheckPointPath := "./runtime/tickets.checkpoint.json"
 	localMessagesCheckPointPath := "./runtime/messages.checkpoint.json"
+	localHistoryPath := "./runtime/history.json"
+	localAliasProposalsPath := "./runtime/alias.proposals.json"
+	localAliasOverlayPath := "./runtime/alias.overlay.json"
 
+	storage := service.NewMaimaiStorage(source, aliasPath)
+	storage.SetAllowUtage(policy.AllowUtage)
+	storage.SetAllowLocked(policy.AllowLocked)
+	history := service.NewHistory(localHistoryPath)
 	l := &LocalServer{
-		router:         gin.Default(),
-		TicketMaster:   service.NewMaimaiTicketMaster(songDB, aliasPath, localTicketsCheckPointPath, 12),
-		MessageManager: model.NewMessageManager(localMessagesCheckPointPath, 3, 10*time.Second),
-		taskChan:       taskChan,
+		router:               gin.Default(),
+		TicketMaster:         service.NewMaimaiTicketMaster(storage, localTicketsCheckPointPath, 12, policy, history),
+		MessageManager:       model.NewMessageManager(localMessagesCheckPointPath, 3, 10*time.Second),
+		History:              history,
+		Aliases:              service.NewAliasModerator(storage, localAliasProposalsPath, localAliasOverlayPath),
+		AliasRefreshInterval: defaultAliasRefreshInterval,
+		storage:              storage,
+		taskChan:             taskChan,
+		taskDone:             make(chan struct{}),
+		lastDanmu:            map[string]recentDanmu{},
+		access:               access,
+		permissions:          model.NewPermissions(access.Moderators),
 	}
+	l.access.ensureToken()
 	l.Register()
 	if l.taskChan != nil {
 		go l.taskRoutine(l.taskChan)
+	} else {
+		close(l.taskDone)
 	}
 
 	return l
 }
 
 func (l *LocalServer) taskRoutine(tasker chan *model.Task) {
+	defer close(l.taskDone)
 	for {
 		task := <-tasker
 		if task == nil { // shutdown
+			if err := l.History.EndSession(time.Now()); err != nil {
+				log.Printf("failed to end session %v", err)
+			}
 			break
 		}
 		_, err := l.taskHandler(task)
@@ -53,35 +97,196 @@ func (l *LocalServer) taskRoutine(tasker chan *model.Task) {
 func (l *LocalServer) taskHandler(task *model.Task) (msg string, err error) {
 	var cmd = task.Command
 	var caller = task.Caller
+	var viewer = task.GetViewer()
 	var content = task.Content
 	var index = task.Index
 
-	if cmd == model.CommandPick {
-		msg, err = l.TicketMaster.AddTicket(caller, content)
-	} else {
-		switch cmd {
-		case model.CommandFinish:
-			msg, err = l.TicketMaster.FinishTicket(caller, index)
-		case model.CommandNextRank:
-			msg, err = l.TicketMaster.NextRank(caller, index)
-		case model.CommandNextLevel:
-			msg, err = l.TicketMaster.NextLevel(caller, index)
+	l.permissions.Resolve(viewer)
+	switch cmd {
+	case model.CommandSessionStart:
+		log.Printf("session %s started by %s", content, caller)
+		l.permissions.SetAnchor(viewer.OpenID, viewer.Name)
+		if err := l.History.SetSession(content, time.Now()); err != nil {
+			log.Printf("failed to record session %v", err)
 		}
+	case model.CommandChat:
+		l.setLastDanmu(viewer, content)
+	case model.CommandPick:
+		l.setLastDanmu(viewer, content)
+		msg, err = l.TicketMaster.AddTicket(viewer, content)
+	case model.CommandFinish:
+		msg, err = l.TicketMaster.FinishTicket(viewer, index)
+	case model.CommandNextRank:
+		msg, err = l.TicketMaster.NextRank(viewer, index)
+	case model.CommandNextLevel:
+		msg, err = l.TicketMaster.NextLevel(viewer, index)
+	case model.CommandMove:
+		msg, err = l.TicketMaster.MoveTicket(viewer, index, task.Target)
+	case model.CommandSwap:
+		msg, err = l.TicketMaster.SwapTickets(viewer, index, task.Target)
+	case model.CommandPin:
+		msg, err = l.TicketMaster.PinTicket(viewer, index)
+	case model.CommandClear:
+		msg, err = l.TicketMaster.ClearTickets(viewer)
+	case model.CommandClearViewer:
+		msg, err = l.TicketMaster.ClearViewerTickets(viewer, index)
+	case model.CommandAlias:
+		msg, err = l.aliasHandler(viewer, content)
+	case model.CommandRandom:
+		msg, err = l.TicketMaster.AddRandomTicket(viewer, content)
+		if errors.Is(err, service.ErrUnknownFilter) {
+			// 如 "随机 应变", 按聊天处理
+			msg, err = "", nil
+			l.setLastDanmu(viewer, bilibili.KeyWordRandom+" "+content)
+		}
+	case model.CommandSearch:
+		msg, err = l.searchHandler(content)
+	case model.CommandGift, model.CommandSuperChat, model.CommandGuard:
+		msg, err = l.paidHandler(task)
+	case model.CommandLike, model.CommandInteractionEnd:
+		log.Printf("event %s from %s: %s x%d", cmd, caller, content, task.Count)
 	}
 	if err != nil {
 		l.MessageManager.Push("err " + caller + " " + err.Error())
-	} else {
+	} else if msg != "" {
 		l.MessageManager.Push("inf " + caller + " " + msg)
 	}
 	return msg, err
 }
 
+// aliasHandler 处理 "别名 <歌曲id或标题> <别名>", 最后一个词为别名; 房管可以审核申请
+func (l *LocalServer) aliasHandler(viewer *model.Viewer, content string) (string, error) {
+	content = strings.TrimSpace(content)
+	if fields := strings.Fields(content); len(fields) > 0 && viewer.Elevated() {
+		switch fields[0] {
+		case aliasKeyWordPending:
+			return l.pendingAliases(), nil
+		case aliasKeyWordApprove, aliasKeyWordReject:
+			if len(fields) != 2 {
+				return "", fmt.Errorf("格式: 别名 %s 申请id", fields[0])
+			}
+			id, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return "", fmt.Errorf("申请id错误 %s", fields[1])
+			}
+			proposal, err := l.Aliases.Review(id, viewer.Name, fields[0] == aliasKeyWordApprove)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("别名 %s → %s %s", proposal.Alias, proposal.Title, fields[0]), nil
+		}
+	}
+	split := strings.LastIndexAny(content, " \t")
+	if split < 0 {
+		return "", errors.New("格式: 别名 歌曲id或标题 别名")
+	}
+	return l.Aliases.Propose(viewer, content[:split], content[split+1:])
+}
+
+// pendingAliases 列出最早的几条待审核申请
+func (l *LocalServer) pendingAliases() string {
+	proposals := l.Aliases.Proposals(service.ProposalPending)
+	if len(proposals) == 0 {
+		return "没有待审核的别名"
+	}
+	var parts []string
+	for _, proposal := range proposals[:min(len(proposals), danmuSearchPreview)] {
+		parts = append(parts, fmt.Sprintf("%d.%s→%s", proposal.ID, proposal.Alias, proposal.Title))
+	}
+	return fmt.Sprintf("待审核%d条: %s", len(proposals), strings.Join(parts, " "))
+}
+
+// searchHandler 处理 "查歌 <关键词>", 列出换歌时依次会换到的歌曲
+func (l *LocalServer) searchHandler(keyword string) (string, error) {
+	if l.storage == nil {
+		return "", errors.New("曲库未加载")
+	}
+	var parts []string
+	for _, candidate := range l.storage.Explain(service.ParsePickQuery(keyword), danmuSearchPreview) {
+		parts = append(parts, fmt.Sprintf("%d.%s(%s)", candidate.Rank+1, candidate.Title, candidate.Alias))
+	}
+	return keyword + ": " + strings.Join(parts, " "), nil
+}
+
+// paidHandler 处理礼物、付费留言与大航海, 达到金额的礼物与付费留言会优先点歌
+func (l *LocalServer) paidHandler(task *model.Task) (string, error) {
+	log.Printf("paid event %s from %s: %s x%d, %d battery", task.Command, task.Caller, task.Content, task.Count, task.Price)
+	var viewer = task.GetViewer()
+	var keyword string
+	switch task.Command {
+	case model.CommandSuperChat:
+		keyword = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(task.Content), bilibili.KeyWordPick))
+	case model.CommandGift:
+		keyword = l.getLastDanmu(viewer)
+	default:
+		return "", nil
+	}
+	if keyword == "" {
+		return "", nil
+	}
+	msg, err := l.TicketMaster.AddPaidTicket(viewer, keyword, task.Price)
+	if errors.Is(err, service.ErrPaidBelowThreshold) {
+		return "", nil
+	}
+	if err == nil && task.Command == model.CommandGift {
+		l.setLastDanmu(viewer, "")
+	}
+	return msg, err
+}
+
+type recentDanmu struct {
+	content string
+	at      time.Time
+}
+
+// setLastDanmu 超过 maxLastDanmu 位观众时先丢弃过期的, 仍然超过时丢弃最早的
+func (l *LocalServer) setLastDanmu(viewer *model.Viewer, content string) {
+	l.lastDanmuLock.Lock()
+	defer l.lastDanmuLock.Unlock()
+	if content == "" {
+		delete(l.lastDanmu, viewer.ID())
+		return
+	}
+	now := time.Now()
+	if _, ok := l.lastDanmu[viewer.ID()]; !ok && len(l.lastDanmu) >= maxLastDanmu {
+		oldest := ""
+		for id, danmu := range l.lastDanmu {
+			if now.Sub(danmu.at) > lastDanmuTTL {
+				delete(l.lastDanmu, id)
+			} else if oldest == "" || danmu.at.Before(l.lastDanmu[oldest].at) {
+				oldest = id
+			}
+		}
+		if len(l.lastDanmu) >= maxLastDanmu {
+			delete(l.lastDanmu, oldest)
+		}
+	}
+	l.lastDanmu[viewer.ID()] = recentDanmu{content: content, at: now}
+}
+
+func (l *LocalServer) getLastDanmu(viewer *model.Viewer) string {
+	l.lastDanmuLock.Lock()
+	defer l.lastDanmuLock.Unlock()
+	danmu, ok := l.lastDanmu[viewer.ID()]
+	if !ok || time.Since(danmu.at) > lastDanmuTTL {
+		return ""
+	}
+	return danmu.content
+}
+
 const (
 	FrontendEventClickCoverInfo = "click_cover_info"
 	FrontendEventClickGenreInfo = "click_genre_info"
 	FrontendEventClickSongInfo  = "click_song_info"
 	FrontendEventClickCreator   = "click_creator"
 	FrontendEventPick           = "pick"
+	FrontendEventMove           = "move"
+	FrontendEventSwap           = "swap"
+	FrontendEventPin            = "pin"
+	FrontendEventClear          = "clear"
+	FrontendEventClearViewer    = "clear_viewer"
+	// FrontendEventRandom 的内容为随机点歌的条件, 不限制时为 all
+	FrontendEventRandom = "random"
 )
 
 func (l *LocalServer) Event(c *gin.Context) {
@@ -92,6 +297,18 @@ func (l *LocalServer) Event(c *gin.Context) {
 	if err != nil {
 		index = -1
 	}
+	// move/swap 的内容为 "from,to"
+	var target int64 = -1
+	if from, to, ok := strings.Cut(content, ","); ok {
+		index, err = strconv.ParseInt(strings.TrimSpace(from), 10, 64)
+		if err != nil {
+			index = -1
+		}
+		target, err = strconv.ParseInt(strings.TrimSpace(to), 10, 64)
+		if err != nil {
+			target = -1
+		}
+	}
 	var command string
 	switch event {
 	case FrontendEventClickCoverInfo:
@@ -104,6 +321,18 @@ func (l *LocalServer) Event(c *gin.Context) {
 		command = model.CommandPick
 	case FrontendEventClickCreator:
 		command = model.CommandPick
+	case FrontendEventMove:
+		command = model.CommandMove
+	case FrontendEventSwap:
+		command = model.CommandSwap
+	case FrontendEventPin:
+		command = model.CommandPin
+	case FrontendEventClear:
+		command = model.CommandClear
+	case FrontendEventClearViewer:
+		command = model.CommandClearViewer
+	case FrontendEventRandom:
+		command = model.CommandRandom
 	}
 
 	msg, err := l.taskHandler(&model.Task{
@@ -111,6 +340,11 @@ func (l *LocalServer) Event(c *gin.Context) {
 		Caller:  caller,
 		Content: content,
 		Index:   index,
+		Target:  target,
+		Viewer: &model.Viewer{
+			Name: caller,
+			Role: model.RoleAnchor,
+		},
 	})
 
 	if err == nil {
@@ -139,10 +373,18 @@ type TicketItem struct {
 	Keyword string `json:"keyword"`
 	Creator string `json:"creator"`
 	Image   string `json:"image"`
+	Price   int64  `json:"price"`
+	Pinned  bool   `json:"pinned"`
 
 	CoverInfo string `json:"cover_info"`
 	GenreInfo string `json:"genre_info"`
 	SongInfo  string `json:"song_info"`
+
+	Artist  string `json:"artist,omitempty"`
+	BPM     int    `json:"bpm,omitempty"`
+	Version string `json:"version,omitempty"`
+	Charter string `json:"charter,omitempty"`
+	Notes   int    `json:"notes,omitempty"`
 }
 
 type GetTicketsResponse struct {
@@ -156,40 +398,232 @@ func (l *LocalServer) Tickets(c *gin.Context) {
 			Title:     ticket.GetTitle(),
 			Keyword:   ticket.GetKeyword(),
 			Creator:   ticket.GetCreator(),
-			Image:     ticket.GetCoverPath(),
+			Image:     l.coverURL(ticket),
+			Price:     ticket.GetPrice(),
+			Pinned:    ticket.IsPinned(),
 			CoverInfo: ticket.GetCoverInfo(),
 			GenreInfo: ticket.GetGenreInfo(),
 			SongInfo:  ticket.GetSongInfo(),
+			Artist:    ticket.GetArtist(),
+			BPM:       ticket.GetBPM(),
+			Version:   ticket.GetVersion(),
+			Charter:   ticket.GetCharter(),
+			Notes:     ticket.GetNotes(),
 		})
 	})
 
 	c.JSON(200, gin.H{"data": result})
 }
 
+// HistoryEntries 点歌历史, ?session= 指定场次, 为空时返回全部
+func (l *LocalServer) HistoryEntries(c *gin.Context) {
+	c.JSON(200, gin.H{"data": l.History.Entries(c.Query("session"))})
+}
+
+func (l *LocalServer) HistorySessions(c *gin.Context) {
+	c.JSON(200, gin.H{"data": l.History.Sessions()})
+}
+
+// HistoryStats 点歌统计, ?session= 指定场次, ?top= 指定排行数量, 默认 10
+func (l *LocalServer) HistoryStats(c *gin.Context) {
+	top, err := strconv.Atoi(c.DefaultQuery("top", "10"))
+	if err != nil {
+		c.JSON(400, gin.H{"msg": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"data": l.History.Stats(c.Query("session"), top)})
+}
+
+// Search 关键词的候选歌曲及得分、命中的别名, ?keyword= 必填, 可以带谱面条件, ?limit= 默认 10
+func (l *LocalServer) Search(c *gin.Context) {
+	keyword := strings.TrimSpace(c.Query("keyword"))
+	if keyword == "" {
+		c.JSON(400, gin.H{"msg": "keyword is required"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit < 1 || limit > maxSearchLimit {
+		c.JSON(400, gin.H{"msg": fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit)})
+		return
+	}
+	if l.storage == nil {
+		c.JSON(503, gin.H{"msg": "曲库未加载"})
+		return
+	}
+	c.JSON(200, gin.H{"data": l.storage.Explain(service.ParsePickQuery(keyword), limit)})
+}
+
+// jacketRoute 本地封面的地址前缀
+const jacketRoute = "/api/jackets/"
+
+// coverURL 本地有封面时指向本地服务, 否则使用曲库中的封面地址
+func (l *LocalServer) coverURL(ticket model.ITicket) string {
+	if l.Jackets == nil || l.storage == nil {
+		return ticket.GetCoverPath()
+	}
+	if record, ok := l.storage.Record(ticket.GetSongID()); ok && l.Jackets.Has(record) {
+		return jacketRoute + strconv.Itoa(ticket.GetSongID())
+	}
+	return ticket.GetCoverPath()
+}
+
+// Jacket 本地封面缩略图, 本地没有或生成失败时跳转到曲库中的封面地址
+func (l *LocalServer) Jacket(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"msg": err.Error()})
+		return
+	}
+	if l.storage == nil {
+		c.JSON(503, gin.H{"msg": "曲库未加载"})
+		return
+	}
+	record, ok := l.storage.Record(id)
+	if !ok {
+		c.JSON(404, gin.H{"msg": "歌曲不存在"})
+		return
+	}
+	if l.Jackets != nil && l.Jackets.Has(record) {
+		path, err := l.Jackets.Thumbnail(record)
+		if err == nil {
+			c.Header("Cache-Control", "public, max-age=86400")
+			c.File(path)
+			return
+		}
+		log.Printf("failed to make jacket thumbnail for %d: %v", id, err)
+	}
+	c.Redirect(http.StatusFound, record.ImagePath)
+}
+
+// SongSources 曲库来源, 游戏数据目录有多个时列出各目录加载、覆盖与移除的歌曲
+func (l *LocalServer) SongSources(c *gin.Context) {
+	if l.storage == nil {
+		c.JSON(503, gin.H{"msg": "曲库未加载"})
+		return
+	}
+	name, packages := l.storage.SourceReport()
+	c.JSON(200, gin.H{"data": gin.H{"source": name, "packages": packages}})
+}
+
+// AliasProposals 别名申请, ?status= 指定 pending/approved/rejected, 默认 pending
+func (l *LocalServer) AliasProposals(c *gin.Context) {
+	c.JSON(200, gin.H{"data": l.Aliases.Proposals(c.DefaultQuery("status", service.ProposalPending))})
+}
+
+// ReviewAliasProposal action 为 approve 或 reject
+func (l *LocalServer) ReviewAliasProposal(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"msg": err.Error()})
+		return
+	}
+	var approve bool
+	switch c.Param("action") {
+	case "approve":
+		approve = true
+	case "reject":
+		approve = false
+	default:
+		c.JSON(400, gin.H{"msg": "unknown action " + c.Param("action")})
+		return
+	}
+	reviewer := l.permissions.AnchorName()
+	if reviewer == "" {
+		reviewer = "主播"
+	}
+	proposal, err := l.Aliases.Review(id, reviewer, approve)
+	if errors.Is(err, service.ErrProposalNotFound) {
+		c.JSON(404, gin.H{"msg": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"msg": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"data": proposal})
+}
+
 func (l *LocalServer) Register() {
 	l.router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:3000"},
 		AllowMethods:     []string{"GET", "PUT", "PATCH"},
-		AllowHeaders:     []string{"Origin"},
+		AllowHeaders:     []string{"Origin", AnchorTokenHeader},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
-		AllowOriginFunc: func(origin string) bool {
-			fmt.Println(origin)
-			return true
-		},
-		MaxAge: 12 * time.Hour,
+		AllowOriginFunc:  localOrigin,
+		MaxAge:           12 * time.Hour,
 	}))
 
 	l.router.Static("/static", "./static")
-	l.router.GET("/api/event/:caller/:event/:content", l.Event)
+	l.router.GET("/api/login", l.Login)
+	l.router.GET("/api/event/:caller/:event/:content", l.RequireAnchor, l.Event)
 	l.router.GET("/api/messages", l.Message)
 	l.router.GET("/api/tickets", l.Tickets)
+	l.router.GET("/api/history", l.HistoryEntries)
+	l.router.GET("/api/history/sessions", l.HistorySessions)
+	l.router.GET("/api/history/stats", l.HistoryStats)
+	l.router.GET("/api/search", l.Search)
+	l.router.GET("/api/songs/sources", l.RequireAnchor, l.SongSources)
+	l.router.GET(jacketRoute+":id", l.Jacket)
+	l.router.GET("/api/aliases/proposals", l.RequireAnchor, l.AliasProposals)
+	l.router.GET("/api/aliases/proposals/:id/:action", l.RequireAnchor, l.ReviewAliasProposal)
 }
 
-func (l *LocalServer) Spin() {
-	err := l.router.Run("[::]:41377")
+const (
+	defaultAliasRefreshInterval = 6 * time.Hour
+	shutdownTaskTimeout         = 10 * time.Second
+	shutdownHTTPTimeout         = 5 * time.Second
+	// danmuSearchPreview 查歌与待审别名弹幕回复的条数
+	danmuSearchPreview = 3
+	maxSearchLimit     = 50
+	// lastDanmuTTL 礼物点歌只使用这段时间内的弹幕作为歌名
+	lastDanmuTTL = 5 * time.Minute
+	maxLastDanmu = 1000
 
-	if err != nil {
-		panic(err)
+	// 房管审核别名的弹幕, 如 "别名 通过 3"
+	aliasKeyWordPending = "待审"
+	aliasKeyWordApprove = "通过"
+	aliasKeyWordReject  = "拒绝"
+)
+
+// Spin 启动 HTTP 服务直到 ctx 取消, 之后等待弹幕任务处理完毕、写入检查点并关闭 HTTP 服务
+func (l *LocalServer) Spin(ctx context.Context) {
+	srv := &http.Server{
+		Addr:    "[::]:41377",
+		Handler: l.router,
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- srv.ListenAndServe()
+	}()
+	if l.storage != nil && l.AliasRefreshInterval > 0 {
+		go l.storage.WatchAliases(ctx, l.AliasRefreshInterval)
+	}
+
+	select {
+	case err := <-errChan:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+		return
+	case <-ctx.Done():
+	}
+
+	log.Println("local server shutting down")
+	// 先停止接收请求, 再写入检查点, 避免写入后还有请求修改歌单
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownHTTPTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("failed to shutdown http server %v", err)
+	}
+	select {
+	case <-l.taskDone:
+	case <-time.After(shutdownTaskTimeout):
+		log.Println("timeout waiting for task routine to exit")
+	}
+	if err := l.TicketMaster.Flush(); err != nil {
+		log.Printf("failed to flush tickets %v", err)
+	}
+	if err := l.MessageManager.Flush(); err != nil {
+		log.Printf("failed to flush messages %v", err)
 	}
 }
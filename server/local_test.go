@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"wolfy/model"
+	"wolfy/service"
+	"wolfy/service/bilibili"
+	"wolfy/service/bilibili/bilibilitest"
+)
+
+type recordingTicketMaster struct {
+	calls chan string
+}
+
+func newRecordingTicketMaster() *recordingTicketMaster {
+	return &recordingTicketMaster{calls: make(chan string, 16)}
+}
+
+func (r *recordingTicketMaster) record(format string, args ...interface{}) (string, error) {
+	r.calls <- fmt.Sprintf(format, args...)
+	return "ok", nil
+}
+
+func (r *recordingTicketMaster) AddTicket(creator *model.Viewer, keyword string) (string, error) {
+	return r.record("pick %s %s", creator.Name, keyword)
+}
+
+func (r *recordingTicketMaster) AddPaidTicket(creator *model.Viewer, keyword string, price int64) (string, error) {
+	return r.record("paid_pick %s %s %d", creator.Name, keyword, price)
+}
+
+func (r *recordingTicketMaster) AddRandomTicket(creator *model.Viewer, filters string) (string, error) {
+	if filters == "应变" {
+		return "", fmt.Errorf("%w %s", service.ErrUnknownFilter, filters)
+	}
+	return r.record("random %s %q", creator.Name, filters)
+}
+
+func (r *recordingTicketMaster) FinishTicket(operator *model.Viewer, index int64) (string, error) {
+	return r.record("finish %s %d", operator.Name, index)
+}
+
+func (r *recordingTicketMaster) ForEachTicket(fn func(model.ITicket)) {}
+
+func (r *recordingTicketMaster) NextLevel(operator *model.Viewer, index int64) (string, error) {
+	return r.record("next_level %s %d", operator.Name, index)
+}
+
+func (r *recordingTicketMaster) NextRank(operator *model.Viewer, index int64) (string, error) {
+	return r.record("next_rank %s %d", operator.Name, index)
+}
+
+func (r *recordingTicketMaster) MoveTicket(operator *model.Viewer, from int64, to int64) (string, error) {
+	return r.record("move %s %d %d", operator.Name, from, to)
+}
+
+func (r *recordingTicketMaster) SwapTickets(operator *model.Viewer, a int64, b int64) (string, error) {
+	return r.record("swap %s %d %d", operator.Name, a, b)
+}
+
+func (r *recordingTicketMaster) PinTicket(operator *model.Viewer, index int64) (string, error) {
+	return r.record("pin %s %d", operator.Name, index)
+}
+
+func (r *recordingTicketMaster) ClearTickets(operator *model.Viewer) (string, error) {
+	return r.record("clear %s", operator.Name)
+}
+
+func (r *recordingTicketMaster) ClearViewerTickets(operator *model.Viewer, index int64) (string, error) {
+	return r.record("clear_viewer %s %d", operator.Name, index)
+}
+
+func (r *recordingTicketMaster) Flush() error {
+	return nil
+}
+
+func (r *recordingTicketMaster) expect(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case got := <-r.calls:
+		if got != want {
+			t.Fatalf("got call %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for call %q", want)
+	}
+}
+
+func Test_DanmuFlowsIntoTaskHandler(t *testing.T) {
+	fake := bilibilitest.NewServer("ak", "sk", 42, "anchor-code")
+	defer fake.Close()
+
+	app := bilibili.NewAppService(42, "anchor-code", bilibili.NewLocalSignatory("ak", "sk"))
+	app.HttpHost = fake.URL
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	taskChan := app.Spin(ctx)
+	if err := fake.WaitAuthed(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	master := newRecordingTicketMaster()
+	l := &LocalServer{
+		TicketMaster:   master,
+		MessageManager: model.NewMessageManager("", 3, 10*time.Second),
+		History:        service.NewHistory(""),
+		taskChan:       taskChan,
+		taskDone:       make(chan struct{}),
+		lastDanmu:      map[string]recentDanmu{},
+		permissions:    model.NewPermissions(nil),
+	}
+	go l.taskRoutine(l.taskChan)
+
+	for _, danmu := range []string{"点歌系统", "删除 2", "换歌 1", "换谱 3", "移动 3 1", "清空", "随机 紫 14", "随便聊聊"} {
+		if err := fake.PushDanmu("观众", danmu); err != nil {
+			t.Fatal(err)
+		}
+	}
+	master.expect(t, "pick 观众 系统")
+	master.expect(t, "finish 观众 1")
+	master.expect(t, "next_rank 观众 0")
+	master.expect(t, "next_level 观众 2")
+	master.expect(t, "move 观众 2 0")
+	master.expect(t, "clear 观众")
+	master.expect(t, `random 观众 "紫 14"`)
+
+	// 礼物使用最近一条弹幕作为歌名, 付费留言使用留言内容
+	if err := fake.Push(bilibili.OpenPlatformSendGiftCmd, map[string]interface{}{
+		"open_id": "fake-open-id-观众", "uname": "观众", "gift_name": "小电视", "gift_num": 1, "price": 1245000, "paid": true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Push(bilibili.OpenPlatformSuperChatCmd, map[string]interface{}{
+		"uname": "路人", "message": "点歌 潘", "rmb": 30,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	master.expect(t, "paid_pick 观众 随便聊聊 12450")
+	master.expect(t, "paid_pick 路人 潘 300")
+
+	if fake.Calls("/v2/app/start") != 1 {
+		t.Fatalf("expected one /v2/app/start, got %d", fake.Calls("/v2/app/start"))
+	}
+
+	cancel()
+	select {
+	case <-l.taskDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task routine did not exit after shutdown")
+	}
+	if fake.Calls("/v2/app/end") != 1 {
+		t.Fatalf("expected the game to be ended on shutdown, got %d", fake.Calls("/v2/app/end"))
+	}
+}
+
+func Test_UnknownRandomFiltersAreChat(t *testing.T) {
+	l := &LocalServer{
+		TicketMaster:   newRecordingTicketMaster(),
+		MessageManager: model.NewMessageManager("", 3, 10*time.Second),
+		lastDanmu:      map[string]recentDanmu{},
+		permissions:    model.NewPermissions(nil),
+	}
+	viewer := &model.Viewer{OpenID: "open-a", Name: "a"}
+	if _, err := l.taskHandler(&model.Task{Command: model.CommandRandom, Caller: "a", Content: "应变", Viewer: viewer}); err != nil {
+		t.Fatalf("expected unknown filters to be treated as chat, got %v", err)
+	}
+	l.MessageManager.ForEachMessage(func(message *model.Message) {
+		t.Fatalf("expected no message, got %+v", message)
+	})
+	if got := l.getLastDanmu(viewer); got != "随机 应变" {
+		t.Fatalf("expected chat to be remembered, got %q", got)
+	}
+}
+
+func Test_EventRequiresAnchorToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	master := newRecordingTicketMaster()
+	l := &LocalServer{
+		TicketMaster:   master,
+		MessageManager: model.NewMessageManager("", 3, 10*time.Second),
+		History:        service.NewHistory(""),
+		router:         gin.New(),
+		lastDanmu:      map[string]recentDanmu{},
+		access:         AccessConfig{AnchorToken: "secret"},
+		permissions:    model.NewPermissions(nil),
+	}
+	l.Register()
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		l.router.ServeHTTP(w, req)
+		return w
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/event/主播/click_cover_info/0", nil)
+	if w := serve(req); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/event/主播/click_cover_info/0", nil)
+	req.Header.Set(AnchorTokenHeader, "wrong")
+	if w := serve(req); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with wrong token, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/login?token=secret", nil)
+	w := serve(req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected login redirect, got %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != AnchorTokenCookie {
+		t.Fatalf("expected anchor cookie, got %v", cookies)
+	}
+
+	if cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Fatalf("expected strict anchor cookie, got %v", cookies[0].SameSite)
+	}
+
+	// 其他网页链接到控制台操作时不使用 cookie
+	req = httptest.NewRequest(http.MethodGet, "/api/event/主播/clear/0", nil)
+	req.AddCookie(cookies[0])
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	if w := serve(req); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for cross-site navigation, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/event/主播/click_cover_info/0", nil)
+	req.AddCookie(cookies[0])
+	if w := serve(req); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with cookie, got %d %s", w.Code, w.Body.String())
+	}
+	master.expect(t, "finish 主播 0")
+
+	req = httptest.NewRequest(http.MethodGet, "/api/event/主播/swap/2,0", nil)
+	req.AddCookie(cookies[0])
+	if w := serve(req); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with cookie, got %d %s", w.Code, w.Body.String())
+	}
+	master.expect(t, "swap 主播 2 0")
+}
+
+func Test_CORSOnlyAllowsLocalOrigins(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	l := &LocalServer{
+		TicketMaster:   newRecordingTicketMaster(),
+		MessageManager: model.NewMessageManager("", 3, 10*time.Second),
+		History:        service.NewHistory(""),
+		router:         gin.New(),
+		lastDanmu:      map[string]recentDanmu{},
+		permissions:    model.NewPermissions(nil),
+	}
+	l.Register()
+
+	for origin, allowed := range map[string]bool{
+		"http://localhost:3000":  true,
+		"http://127.0.0.1:41377": true,
+		"http://[::1]:3000":      true,
+		"https://evil.example":   false,
+		"http://localhost.evil":  false,
+		"null":                   false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/messages", nil)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		l.router.ServeHTTP(w, req)
+		if got := w.Header().Get("Access-Control-Allow-Origin") == origin; got != allowed {
+			t.Fatalf("%s: expected allowed=%v, got status %d header %q", origin, allowed, w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+	}
+}
+
+func Test_LastDanmuIsBounded(t *testing.T) {
+	l := &LocalServer{lastDanmu: map[string]recentDanmu{}}
+	stale := &model.Viewer{OpenID: "open-stale"}
+	l.lastDanmu[stale.ID()] = recentDanmu{content: "系统", at: time.Now().Add(-lastDanmuTTL - time.Second)}
+	if got := l.getLastDanmu(stale); got != "" {
+		t.Fatalf("expected stale danmu to be ignored, got %q", got)
+	}
+
+	for i := 0; i < maxLastDanmu+10; i++ {
+		l.setLastDanmu(&model.Viewer{OpenID: fmt.Sprintf("open-%d", i)}, "潘")
+	}
+	if len(l.lastDanmu) != maxLastDanmu {
+		t.Fatalf("expected at most %d viewers, got %d", maxLastDanmu, len(l.lastDanmu))
+	}
+	if _, ok := l.lastDanmu[stale.ID()]; ok {
+		t.Fatal("expected stale danmu to be dropped first")
+	}
+	if got := l.getLastDanmu(&model.Viewer{OpenID: fmt.Sprintf("open-%d", maxLastDanmu+9)}); got != "潘" {
+		t.Fatalf("expected latest danmu to be kept, got %q", got)
+	}
+}
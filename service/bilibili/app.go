@@ -2,101 +2,227 @@ package bilibili
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
+	"sync"
 	"time"
 	"wolfy/model"
 )
 
+const (
+	ReconnectMinBackoff = time.Second
+	ReconnectMaxBackoff = time.Minute
+)
+
 type AppService struct {
 	AppId      int64
 	AnchorCode string
-	signatory  ISignatory
-	taskChan   chan *model.Task
+	// HttpHost 开放平台地址, 默认为 OpenPlatformHttpHost, 测试时可替换
+	HttpHost  string
+	signatory ISignatory
+	taskChan  chan *model.Task
+
+	lock   sync.Mutex
+	gameId string
+	anchor AnchorInfo
 }
 
 func NewAppService(appId int64, anchorCode string, signatory ISignatory) *AppService {
 	return &AppService{
 		AppId:      appId,
 		AnchorCode: anchorCode,
+		HttpHost:   OpenPlatformHttpHost,
 		signatory:  signatory,
 		taskChan:   make(chan *model.Task),
 	}
 }
-func (a *AppService) Spin() chan *model.Task {
-	var resp *BaseResp
-	var err error
+
+// Spin 开启场次与长连, ctx 取消后关闭长连、结束场次, 并向 taskChan 发送 nil 通知下游退出
+func (a *AppService) Spin(ctx context.Context) chan *model.Task {
+	client := a.connect(ctx)
+
+	go func() {
+		ticker := time.NewTicker(time.Second * 20)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			_, err := a.appHeart(a.GameId())
+			if err != nil {
+				log.Printf("app heart failed, %v\n", err)
+			}
+		}
+	}()
+
+	// 断线重连, 退出时结束场次
+	go a.keepAlive(ctx, client)
+	return a.taskChan
+}
+
+// GameId 当前场次id, 重连后会变化
+func (a *AppService) GameId() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.gameId
+}
+
+// keepAlive 长连断开后重新开启场次并重连, 连续失败时指数退避
+func (a *AppService) keepAlive(ctx context.Context, client *WebsocketClient) {
+	defer a.shutdown()
+	if client == nil {
+		return
+	}
+	a.announce()
+	var backoff time.Duration
 	for {
-		resp, err = a.startApp()
+		select {
+		case <-ctx.Done():
+			client.Close()
+			return
+		case <-client.Done():
+		}
+		log.Printf("websocket closed, %v, reconnecting", client.Err())
+		if client.Authed() && time.Since(client.connectedAt) > ReconnectMaxBackoff {
+			backoff = 0
+		} else {
+			backoff = nextBackoff(backoff)
+		}
+		if !sleep(ctx, backoff) {
+			return
+		}
+
+		if gameId := a.GameId(); gameId != "" {
+			_, err := a.endApp(gameId, a.AppId)
+			if err != nil {
+				log.Printf("end previous app failed, %v\n", err)
+			}
+		}
+		client = a.connect(ctx)
+		if client == nil {
+			return
+		}
+		a.announce()
+	}
+}
+
+// announce 通知下游新的场次与主播信息
+func (a *AppService) announce() {
+	a.lock.Lock()
+	gameId, anchor := a.gameId, a.anchor
+	a.lock.Unlock()
+	a.taskChan <- &model.Task{
+		Command: model.CommandSessionStart,
+		Caller:  anchor.Uname,
+		Content: gameId,
+		Viewer: &model.Viewer{
+			OpenID: anchor.OpenId,
+			UID:    anchor.Uid,
+			Name:   anchor.Uname,
+			Role:   model.RoleAnchor,
+		},
+	}
+}
+
+// shutdown 结束当前场次并通知下游退出
+func (a *AppService) shutdown() {
+	log.Println("WebsocketClient exit")
+	//关闭应用
+	if gameId := a.GameId(); gameId != "" {
+		_, err := a.endApp(gameId, a.AppId)
 		if err != nil {
-			log.Printf("app service start failed, %v, restarting", err)
-			time.Sleep(time.Second)
-			continue
+			log.Printf("end app failed, %v\n", err)
 		}
-		break
 	}
-	startAppRespData := &StartAppRespData{}
-	err = json.Unmarshal(resp.Data, &startAppRespData)
-	if err != nil {
-		panic(err)
+	a.taskChan <- nil
+}
+
+// connect 开启场次并依次尝试 WssLink 中的地址, 直到连接成功; ctx 取消时返回 nil
+func (a *AppService) connect(ctx context.Context) *WebsocketClient {
+	var backoff time.Duration
+	for {
+		client, err := a.tryConnect()
+		if err == nil {
+			return client
+		}
+		backoff = nextBackoff(backoff)
+		log.Printf("app service start failed, %v, restarting in %v", err, backoff)
+		if !sleep(ctx, backoff) {
+			return nil
+		}
 	}
+}
 
-	if startAppRespData == nil {
-		log.Println("start app get msg err")
-		panic("start app get msg err")
+// sleep 等待 d, ctx 先被取消时返回 false
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
 	}
+}
 
+func (a *AppService) tryConnect() (*WebsocketClient, error) {
+	resp, err := a.startApp()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != 0 {
+		return nil, fmt.Errorf("start app code %d: %s", resp.Code, resp.Message)
+	}
+	startAppRespData := &StartAppRespData{}
+	err = json.Unmarshal(resp.Data, startAppRespData)
+	if err != nil {
+		return nil, err
+	}
 	if len(startAppRespData.WebsocketInfo.WssLink) == 0 {
-		panic("start app websocket info get msg err")
+		return nil, fmt.Errorf("start app websocket info get msg err")
 	}
 
-	go func(gameId string) {
-		for {
-			time.Sleep(time.Second * 20)
-			_, err = a.appHeart(gameId)
-			if err != nil {
-				log.Printf("app heart failed, %v\n", err)
-			}
-		}
-	}(startAppRespData.GameInfo.GameId)
+	a.lock.Lock()
+	a.gameId = startAppRespData.GameInfo.GameId
+	a.anchor = startAppRespData.AnchorInfo
+	a.lock.Unlock()
 
 	// 开启长连
-	err = StartWebsocket(
-		startAppRespData.WebsocketInfo.WssLink[0],
-		startAppRespData.WebsocketInfo.AuthBody,
-		a.taskChan)
-	if err != nil {
-		fmt.Println(err)
-		panic(err)
+	for _, link := range startAppRespData.WebsocketInfo.WssLink {
+		client, err := StartWebsocket(link, startAppRespData.WebsocketInfo.AuthBody, a.taskChan)
+		if err != nil {
+			log.Printf("websocket %s connect failed, %v\n", link, err)
+			continue
+		}
+		return client, nil
+	}
+	// 长连都失败时结束本次场次, 否则每次重试都会遗留一个场次
+	if _, err = a.endApp(startAppRespData.GameInfo.GameId, a.AppId); err != nil {
+		log.Printf("end app failed, %v\n", err)
 	}
+	a.lock.Lock()
+	a.gameId = ""
+	a.lock.Unlock()
+	return nil, fmt.Errorf("all websocket links failed")
+}
 
-	// 退出
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
-	go func() {
-		for {
-			s := <-c
-			switch s {
-			case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
-				log.Println("WebsocketClient exit")
-				break
-			case syscall.SIGHUP:
-			default:
-				break
-			}
-			//关闭应用
-			_, err = a.endApp(startAppRespData.GameInfo.GameId, a.AppId)
-			if err != nil {
-				panic(err)
-			}
-		}
-	}()
-	return a.taskChan
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff < ReconnectMinBackoff {
+		return ReconnectMinBackoff
+	}
+	backoff *= 2
+	if backoff > ReconnectMaxBackoff {
+		backoff = ReconnectMaxBackoff
+	}
+	return backoff
 }
 
 func (a *AppService) startApp() (resp *BaseResp, err error) {
@@ -136,7 +262,7 @@ func (a *AppService) apiRequest(reqJson, requestUrl string) (*BaseResp, error) {
 
 	req, err := http.NewRequest(
 		http.MethodPost,
-		fmt.Sprintf("%s%s", OpenPlatformHttpHost, requestUrl),
+		fmt.Sprintf("%s%s", a.HttpHost, requestUrl),
 		bytes.NewBuffer([]byte(reqJson)))
 	req.Header = header.ToHTTPHeader()
 
@@ -0,0 +1,98 @@
+package bilibili_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"wolfy/model"
+	"wolfy/service/bilibili"
+	"wolfy/service/bilibili/bilibilitest"
+)
+
+func expectTask(t *testing.T, taskChan chan *model.Task, content string) {
+	t.Helper()
+	for {
+		select {
+		case task := <-taskChan:
+			if task != nil && task.Command == model.CommandSessionStart {
+				continue
+			}
+			if task == nil || task.Content != content {
+				t.Fatalf("got task %v, want content %q", task, content)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for task %q", content)
+		}
+	}
+}
+
+func Test_ReconnectAfterConnectionDrop(t *testing.T) {
+	fake := bilibilitest.NewServer("ak", "sk", 42, "anchor-code")
+	fake.BrokenLinks = []string{"ws://127.0.0.1:1/sub"}
+	defer fake.Close()
+
+	app := bilibili.NewAppService(42, "anchor-code", bilibili.NewLocalSignatory("ak", "sk"))
+	app.HttpHost = fake.URL
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	taskChan := app.Spin(ctx)
+	if err := fake.WaitAuthed(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	firstGame := app.GameId()
+	if err := fake.PushDanmu("观众", "点歌 before"); err != nil {
+		t.Fatal(err)
+	}
+	expectTask(t, taskChan, "before")
+
+	fake.DropConnections()
+	if err := fake.WaitAuthed(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.PushDanmu("观众", "点歌 after"); err != nil {
+		t.Fatal(err)
+	}
+	expectTask(t, taskChan, "after")
+
+	if got := fake.Calls("/v2/app/start"); got != 2 {
+		t.Fatalf("expected 2 /v2/app/start, got %d", got)
+	}
+	if got := fake.Calls("/v2/app/end"); got != 1 {
+		t.Fatalf("expected previous game to be ended once, got %d", got)
+	}
+	if app.GameId() == firstGame {
+		t.Fatalf("expected a fresh game id after reconnect, still %s", firstGame)
+	}
+}
+
+func Test_EndGameWhenAllLinksFail(t *testing.T) {
+	fake := bilibilitest.NewServer("ak", "sk", 42, "anchor-code")
+	fake.BrokenLinks = []string{"ws://127.0.0.1:1/sub"}
+	fake.Unreachable = true
+	defer fake.Close()
+
+	app := bilibili.NewAppService(42, "anchor-code", bilibili.NewLocalSignatory("ak", "sk"))
+	app.HttpHost = fake.URL
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		app.Spin(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for fake.Calls("/v2/app/start") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for retries")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	// 每次重试开启的场次都要结束
+	if start, end := fake.Calls("/v2/app/start"), fake.Calls("/v2/app/end"); start != end {
+		t.Fatalf("expected every started game to be ended, started %d ended %d", start, end)
+	}
+}
@@ -0,0 +1,343 @@
+// Package bilibilitest 提供进程内的开放平台模拟服务, 用于不连接 live-open.biliapi.com 的端到端测试
+package bilibilitest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+	"wolfy/service/bilibili"
+)
+
+const (
+	CodeOK           = int64(0)
+	CodeInvalidSign  = int64(-401)
+	CodeInvalidParam = int64(-400)
+)
+
+// Server 模拟开放平台的 /v2/app/* 接口与弹幕长连
+type Server struct {
+	// URL 作为 AppService.HttpHost 使用
+	URL string
+
+	AccessKeyId     string
+	AccessKeySecret string
+	AppId           int64
+	AnchorCode      string
+	AuthBody        string
+	Anchor          bilibili.AnchorInfo
+	// BrokenLinks 排在可用地址之前返回的 WssLink, 用于测试备用地址
+	BrokenLinks []string
+	// Unreachable 为 true 时只返回 BrokenLinks, 模拟所有长连地址都不可用
+	Unreachable bool
+
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	lock   sync.Mutex
+	conns  []*conn
+	calls  map[string]int
+	games  map[string]bool
+	gameId string
+	authed chan struct{}
+}
+
+type conn struct {
+	lock sync.Mutex
+	ws   *websocket.Conn
+}
+
+func (c *conn) send(p *bilibili.Proto) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ws.WriteMessage(websocket.BinaryMessage, p.Encode())
+}
+
+// NewServer 启动模拟服务, 只接受使用 accessKeyId/accessKeySecret 签名的请求
+func NewServer(accessKeyId, accessKeySecret string, appId int64, anchorCode string) *Server {
+	s := &Server{
+		AccessKeyId:     accessKeyId,
+		AccessKeySecret: accessKeySecret,
+		AppId:           appId,
+		AnchorCode:      anchorCode,
+		AuthBody:        `{"key":"fake-auth-body"}`,
+		Anchor: bilibili.AnchorInfo{
+			RoomId: 1,
+			Uname:  "主播",
+			Uid:    1,
+			OpenId: "fake-anchor-open-id",
+		},
+		calls:  map[string]int{},
+		games:  map[string]bool{},
+		authed: make(chan struct{}, 16),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/app/start", s.start)
+	mux.HandleFunc("/v2/app/heartbeat", s.heartbeat)
+	mux.HandleFunc("/v2/app/end", s.end)
+	mux.HandleFunc("/sub", s.sub)
+	s.server = httptest.NewServer(mux)
+	s.URL = s.server.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Calls 返回某个接口被成功调用的次数
+func (s *Server) Calls(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.calls[path]
+}
+
+// GameId 最近一次 /v2/app/start 分配的场次id
+func (s *Server) GameId() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.gameId
+}
+
+// DropConnections 断开所有长连, 模拟网络抖动
+func (s *Server) DropConnections() {
+	s.lock.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.lock.Unlock()
+	for _, c := range conns {
+		_ = c.ws.Close()
+	}
+}
+
+// WaitAuthed 等待一个长连完成鉴权
+func (s *Server) WaitAuthed(timeout time.Duration) error {
+	select {
+	case <-s.authed:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("no websocket authed in %v", timeout)
+	}
+}
+
+// Push 向所有已鉴权的长连推送一条 cmd 消息
+func (s *Server) Push(cmd string, data interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"cmd":  cmd,
+		"data": data,
+	})
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	conns := append([]*conn(nil), s.conns...)
+	s.lock.Unlock()
+	if len(conns) == 0 {
+		return fmt.Errorf("no authed websocket")
+	}
+	for _, c := range conns {
+		err = c.send(&bilibili.Proto{
+			Operation: bilibili.OP_SEND_SMS_REPLY,
+			Body:      body,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PushDanmu 推送一条 LIVE_OPEN_PLATFORM_DM 弹幕, open_id 由昵称生成
+func (s *Server) PushDanmu(uname, msg string) error {
+	return s.Push(bilibili.OpenPlatformDanmuCmd, map[string]interface{}{
+		"open_id": "fake-open-id-" + uname,
+		"uname":   uname,
+		"msg":     msg,
+		"room_id": s.Anchor.RoomId,
+	})
+}
+
+// verify 按 LocalSignatory 的规则校验签名头, 返回请求体
+func (s *Server) verify(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	header := &bilibili.CommonHeader{
+		Timestamp:        r.Header.Get(bilibili.BiliTimestampHeader),
+		SignatureMethod:  r.Header.Get(bilibili.BiliSignatureMethodHeader),
+		SignatureVersion: r.Header.Get(bilibili.BiliSignVersionHeader),
+		Nonce:            r.Header.Get(bilibili.BiliSignatureNonceHeader),
+		AccessKeyId:      r.Header.Get(bilibili.BiliAccessKeyIdHeader),
+		ContentMD5:       r.Header.Get(bilibili.BiliContentMD5Header),
+	}
+	if header.AccessKeyId != s.AccessKeyId {
+		return nil, fmt.Errorf("unknown access key id %q", header.AccessKeyId)
+	}
+	if header.SignatureMethod != bilibili.HmacSha256 || header.SignatureVersion != bilibili.BiliVersion {
+		return nil, fmt.Errorf("unsupported signature %s %s", header.SignatureMethod, header.SignatureVersion)
+	}
+	if header.ContentMD5 != bilibili.Md5(string(body)) {
+		return nil, fmt.Errorf("content md5 mismatch")
+	}
+	if r.Header.Get(bilibili.AuthorizationHeader) != bilibili.HmacSHA256(s.AccessKeySecret, header.ToSortedString()) {
+		return nil, fmt.Errorf("authorization mismatch")
+	}
+	return body, nil
+}
+
+func (s *Server) reply(w http.ResponseWriter, code int64, message string, data interface{}) {
+	raw, _ := json.Marshal(data)
+	w.Header().Set(bilibili.ContentTypeHeader, bilibili.JsonType)
+	_ = json.NewEncoder(w).Encode(&bilibili.BaseResp{
+		Code:      code,
+		Message:   message,
+		RequestId: fmt.Sprintf("fake-%d", time.Now().UnixNano()),
+		Data:      raw,
+	})
+}
+
+func (s *Server) record(path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.calls[path]++
+}
+
+func (s *Server) active(gameId string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.games[gameId]
+}
+
+func (s *Server) start(w http.ResponseWriter, r *http.Request) {
+	body, err := s.verify(r)
+	if err != nil {
+		s.reply(w, CodeInvalidSign, err.Error(), nil)
+		return
+	}
+	var req bilibili.StartAppRequest
+	if err = json.Unmarshal(body, &req); err != nil || req.Code != s.AnchorCode || req.AppId != s.AppId {
+		s.reply(w, CodeInvalidParam, "invalid code or app_id", nil)
+		return
+	}
+	s.record(r.URL.Path)
+	s.lock.Lock()
+	s.gameId = fmt.Sprintf("fake-game-%d", s.calls[r.URL.Path])
+	s.games[s.gameId] = true
+	gameId := s.gameId
+	s.lock.Unlock()
+	links := append([]string(nil), s.BrokenLinks...)
+	if !s.Unreachable {
+		links = append(links, "ws"+strings.TrimPrefix(s.URL, "http")+"/sub")
+	}
+	s.reply(w, CodeOK, "ok", &bilibili.StartAppRespData{
+		GameInfo: bilibili.GameInfo{GameId: gameId},
+		WebsocketInfo: bilibili.WebSocketInfo{
+			AuthBody: s.AuthBody,
+			WssLink:  links,
+		},
+		AnchorInfo: s.Anchor,
+	})
+}
+
+func (s *Server) heartbeat(w http.ResponseWriter, r *http.Request) {
+	body, err := s.verify(r)
+	if err != nil {
+		s.reply(w, CodeInvalidSign, err.Error(), nil)
+		return
+	}
+	var req bilibili.AppHeartbeatReq
+	if err = json.Unmarshal(body, &req); err != nil || !s.active(req.GameId) {
+		s.reply(w, CodeInvalidParam, "invalid game_id", nil)
+		return
+	}
+	s.record(r.URL.Path)
+	s.reply(w, CodeOK, "ok", struct{}{})
+}
+
+func (s *Server) end(w http.ResponseWriter, r *http.Request) {
+	body, err := s.verify(r)
+	if err != nil {
+		s.reply(w, CodeInvalidSign, err.Error(), nil)
+		return
+	}
+	var req bilibili.EndAppRequest
+	if err = json.Unmarshal(body, &req); err != nil || !s.active(req.GameId) || req.AppId != s.AppId {
+		s.reply(w, CodeInvalidParam, "invalid game_id or app_id", nil)
+		return
+	}
+	s.record(r.URL.Path)
+	s.lock.Lock()
+	delete(s.games, req.GameId)
+	s.lock.Unlock()
+	s.reply(w, CodeOK, "ok", struct{}{})
+}
+
+// sub 长连入口, 先鉴权, 之后回复心跳
+func (s *Server) sub(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &conn{ws: ws}
+	defer s.drop(c)
+	for {
+		_, buf, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		p, err := bilibili.DecodeProto(buf)
+		if err != nil {
+			return
+		}
+		switch p.Operation {
+		case bilibili.OP_AUTH:
+			code := CodeOK
+			if string(p.Body) != s.AuthBody {
+				code = CodeInvalidParam
+			}
+			body, _ := json.Marshal(&bilibili.AuthRespParam{Code: code})
+			if err = c.send(&bilibili.Proto{Operation: bilibili.OP_AUTH_REPLY, Body: body}); err != nil {
+				return
+			}
+			if code != CodeOK {
+				return
+			}
+			s.lock.Lock()
+			s.conns = append(s.conns, c)
+			s.lock.Unlock()
+			select {
+			case s.authed <- struct{}{}:
+			default:
+			}
+		case bilibili.OP_HEARTBEAT:
+			body := make([]byte, 4)
+			binary.BigEndian.PutUint32(body, 1)
+			if err = c.send(&bilibili.Proto{
+				Operation:  bilibili.OP_HEARTBEAT_REPLY,
+				SequenceId: p.SequenceId,
+				Body:       body,
+			}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) drop(c *conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, v := range s.conns {
+		if v == c {
+			s.conns = append(s.conns[:i], s.conns[i+1:]...)
+			break
+		}
+	}
+	_ = c.ws.Close()
+}
@@ -0,0 +1,47 @@
+package bilibilitest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"wolfy/service/bilibili"
+)
+
+func Test_VerifiesSignature(t *testing.T) {
+	fake := NewServer("ak", "sk", 42, "anchor-code")
+	defer fake.Close()
+
+	reqJson := `{"code":"anchor-code","app_id":42}`
+	for _, c := range []struct {
+		signatory bilibili.ISignatory
+		want      int64
+	}{
+		{bilibili.NewLocalSignatory("ak", "sk"), CodeOK},
+		{bilibili.NewLocalSignatory("ak", "wrong"), CodeInvalidSign},
+		{bilibili.NewLocalSignatory("other", "sk"), CodeInvalidSign},
+	} {
+		header, err := c.signatory.Sign(reqJson)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodPost, fake.URL+"/v2/app/start", bytes.NewBufferString(reqJson))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header.ToHTTPHeader()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result bilibili.BaseResp
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Code != c.want {
+			t.Fatalf("got code %d (%s), want %d", result.Code, result.Message, c.want)
+		}
+	}
+}
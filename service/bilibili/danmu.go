@@ -3,6 +3,8 @@ package bilibili
 import (
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 	"wolfy/model"
 )
 
@@ -11,6 +13,13 @@ const (
 	KeyWordRePick    = "换歌"
 	KeyWordNextLevel = "换谱"
 	KeyWordDelete    = "删除"
+	KeyWordMove      = "移动"
+	KeyWordSwap      = "交换"
+	KeyWordPin       = "置顶"
+	KeyWordClear     = "清空"
+	KeyWordAlias     = "别名"
+	KeyWordSearch    = "查歌"
+	KeyWordRandom    = "随机"
 )
 
 func parseDanmu(caller, message string) *model.Task {
@@ -19,19 +28,55 @@ func parseDanmu(caller, message string) *model.Task {
 	message = strings.TrimSpace(message)
 	if strings.HasPrefix(message, KeyWordPick) {
 		command = model.CommandPick
-		message = strings.TrimLeft(message, KeyWordPick)
+		message = strings.TrimSpace(strings.TrimPrefix(message, KeyWordPick))
 	} else {
 		if strings.HasPrefix(message, KeyWordRePick) {
 			command = model.CommandNextRank
-			message = strings.TrimLeft(message, KeyWordPick)
+			message = strings.TrimPrefix(message, KeyWordRePick)
 		} else if strings.HasPrefix(message, KeyWordNextLevel) {
 			command = model.CommandNextLevel
-			message = strings.TrimLeft(message, KeyWordPick)
+			message = strings.TrimPrefix(message, KeyWordNextLevel)
 		} else if strings.HasPrefix(message, KeyWordDelete) {
 			command = model.CommandFinish
-			message = strings.TrimLeft(message, KeyWordDelete)
+			message = strings.TrimPrefix(message, KeyWordDelete)
+		} else if isRandomDanmu(message) {
+			return &model.Task{
+				Command: model.CommandRandom,
+				Caller:  caller,
+				Content: strings.TrimSpace(strings.TrimPrefix(message, KeyWordRandom)),
+				Index:   index,
+			}
+		} else if strings.HasPrefix(message, KeyWordSearch) {
+			message = strings.TrimSpace(strings.TrimPrefix(message, KeyWordSearch))
+			if message == "" {
+				return nil
+			}
+			return &model.Task{
+				Command: model.CommandSearch,
+				Caller:  caller,
+				Content: message,
+				Index:   index,
+			}
+		} else if strings.HasPrefix(message, KeyWordAlias) {
+			message = strings.TrimSpace(strings.TrimPrefix(message, KeyWordAlias))
+			if len(strings.Fields(message)) < 2 {
+				return nil
+			}
+			return &model.Task{
+				Command: model.CommandAlias,
+				Caller:  caller,
+				Content: message,
+				Index:   index,
+			}
+		} else if task := parseQueueDanmu(caller, message); task != nil {
+			return task
 		} else {
-			return nil
+			return &model.Task{
+				Command: model.CommandChat,
+				Caller:  caller,
+				Content: message,
+				Index:   index,
+			}
 		}
 		message = strings.TrimSpace(message)
 		parseInt, err := strconv.ParseInt(message, 10, 64)
@@ -52,3 +97,65 @@ func parseDanmu(caller, message string) *model.Task {
 		Index:   index,
 	}
 }
+
+// isRandomDanmu 只有 "随机" 或 "随机" 后接空白的弹幕是随机点歌, "随机应变" 之类只是聊天
+func isRandomDanmu(message string) bool {
+	rest, ok := strings.CutPrefix(message, KeyWordRandom)
+	if !ok {
+		return false
+	}
+	next, _ := utf8.DecodeRuneInString(rest)
+	return rest == "" || unicode.IsSpace(next)
+}
+
+// parseQueueDanmu 解析歌单管理指令: 移动 <从> <到>, 交换 <甲> <乙>, 置顶 <编号>, 清空 [编号]
+func parseQueueDanmu(caller, message string) *model.Task {
+	var command string
+	var args []string
+	for _, c := range []struct {
+		keyword string
+		command string
+	}{
+		{KeyWordMove, model.CommandMove},
+		{KeyWordSwap, model.CommandSwap},
+		{KeyWordPin, model.CommandPin},
+		{KeyWordClear, model.CommandClear},
+	} {
+		if strings.HasPrefix(message, c.keyword) {
+			command = c.command
+			args = strings.Fields(strings.TrimPrefix(message, c.keyword))
+			break
+		}
+	}
+	if command == "" {
+		return nil
+	}
+
+	var indexes []int64
+	for _, arg := range args {
+		parseInt, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || parseInt < 1 {
+			return nil
+		}
+		indexes = append(indexes, parseInt-1)
+	}
+	task := &model.Task{
+		Command: command,
+		Caller:  caller,
+		Content: strings.Join(args, " "),
+		Index:   -1,
+	}
+	switch {
+	case (command == model.CommandMove || command == model.CommandSwap) && len(indexes) == 2:
+		task.Index, task.Target = indexes[0], indexes[1]
+	case command == model.CommandPin && len(indexes) == 1:
+		task.Index = indexes[0]
+	case command == model.CommandClear && len(indexes) == 0:
+	case command == model.CommandClear && len(indexes) == 1:
+		task.Command = model.CommandClearViewer
+		task.Index = indexes[0]
+	default:
+		return nil
+	}
+	return task
+}
@@ -0,0 +1,140 @@
+package bilibili
+
+import (
+	"encoding/json"
+	"fmt"
+	"wolfy/model"
+)
+
+const (
+	// 开放平台价格单位为 1/1000 元, 1 电池 = 0.1 元
+	pricePerBattery = 100
+	rmbToBattery    = 10
+)
+
+// parseEvent 将一条长连消息转为任务, 不关心的消息返回 nil
+func parseEvent(cmd []byte) (*model.Task, error) {
+	var r RespCmd
+	if err := json.Unmarshal(cmd, &r); err != nil {
+		return nil, err
+	}
+	switch r.Cmd {
+	case OpenPlatformDanmuCmd:
+		var m RespMessage
+		if err := json.Unmarshal(cmd, &m); err != nil {
+			return nil, err
+		}
+		task := parseDanmu(m.Data.Uname, m.Data.Msg)
+		if task != nil {
+			task.Viewer = &model.Viewer{
+				OpenID:         m.Data.OpenID,
+				UID:            int64(m.Data.UID),
+				Name:           m.Data.Uname,
+				GuardLevel:     m.Data.GuardLevel,
+				FansMedalLevel: m.Data.FansMedalLevel,
+				IsAdmin:        m.Data.IsAdmin == 1,
+			}
+		}
+		return task, nil
+	case OpenPlatformSendGiftCmd:
+		var m RespGift
+		if err := json.Unmarshal(cmd, &m); err != nil {
+			return nil, err
+		}
+		var price int64
+		if m.Data.Paid {
+			price = m.Data.Price * m.Data.GiftNum / pricePerBattery
+		}
+		return &model.Task{
+			Command: model.CommandGift,
+			Caller:  m.Data.Uname,
+			Content: m.Data.GiftName,
+			Price:   price,
+			Count:   m.Data.GiftNum,
+			Viewer: &model.Viewer{
+				OpenID:         m.Data.OpenID,
+				UID:            int64(m.Data.UID),
+				Name:           m.Data.Uname,
+				GuardLevel:     m.Data.GuardLevel,
+				FansMedalLevel: m.Data.FansMedalLevel,
+			},
+		}, nil
+	case OpenPlatformSuperChatCmd:
+		var m RespSuperChat
+		if err := json.Unmarshal(cmd, &m); err != nil {
+			return nil, err
+		}
+		return &model.Task{
+			Command: model.CommandSuperChat,
+			Caller:  m.Data.Uname,
+			Content: m.Data.Message,
+			Price:   m.Data.Rmb * rmbToBattery,
+			Count:   1,
+			Viewer: &model.Viewer{
+				OpenID:         m.Data.OpenID,
+				UID:            int64(m.Data.UID),
+				Name:           m.Data.Uname,
+				GuardLevel:     m.Data.GuardLevel,
+				FansMedalLevel: m.Data.FansMedalLevel,
+			},
+		}, nil
+	case OpenPlatformGuardCmd:
+		var m RespGuard
+		if err := json.Unmarshal(cmd, &m); err != nil {
+			return nil, err
+		}
+		return &model.Task{
+			Command: model.CommandGuard,
+			Caller:  m.Data.UserInfo.Uname,
+			Content: guardName(m.Data.GuardLevel),
+			Price:   m.Data.Price * m.Data.GuardNum / pricePerBattery,
+			Count:   m.Data.GuardNum,
+			Viewer: &model.Viewer{
+				OpenID:         m.Data.UserInfo.OpenID,
+				UID:            int64(m.Data.UserInfo.UID),
+				Name:           m.Data.UserInfo.Uname,
+				GuardLevel:     m.Data.GuardLevel,
+				FansMedalLevel: m.Data.FansMedalLevel,
+			},
+		}, nil
+	case OpenPlatformLikeCmd:
+		var m RespLike
+		if err := json.Unmarshal(cmd, &m); err != nil {
+			return nil, err
+		}
+		return &model.Task{
+			Command: model.CommandLike,
+			Caller:  m.Data.Uname,
+			Content: m.Data.LikeText,
+			Count:   m.Data.LikeCount,
+			Viewer: &model.Viewer{
+				OpenID:         m.Data.OpenID,
+				UID:            int64(m.Data.UID),
+				Name:           m.Data.Uname,
+				FansMedalLevel: m.Data.FansMedalLevel,
+			},
+		}, nil
+	case OpenPlatformInteractionEndCmd:
+		var m RespInteractionEnd
+		if err := json.Unmarshal(cmd, &m); err != nil {
+			return nil, err
+		}
+		return &model.Task{
+			Command: model.CommandInteractionEnd,
+			Content: m.Data.GameID,
+		}, nil
+	}
+	return nil, nil
+}
+
+func guardName(level int) string {
+	switch level {
+	case 1:
+		return "总督"
+	case 2:
+		return "提督"
+	case 3:
+		return "舰长"
+	}
+	return fmt.Sprintf("guard_%d", level)
+}
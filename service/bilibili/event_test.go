@@ -0,0 +1,104 @@
+package bilibili
+
+import (
+	"testing"
+	"wolfy/model"
+)
+
+func Test_ParseEvent(t *testing.T) {
+	for _, c := range []struct {
+		raw  string
+		want *model.Task
+	}{
+		{
+			`{"cmd":"LIVE_OPEN_PLATFORM_DM","data":{"uname":"a","msg":"点歌 系统"}}`,
+			&model.Task{Command: model.CommandPick, Caller: "a", Content: "系统", Index: -1},
+		},
+		{
+			`{"cmd":"LIVE_OPEN_PLATFORM_DM","data":{"uname":"a","msg":"晚上好"}}`,
+			&model.Task{Command: model.CommandChat, Caller: "a", Content: "晚上好", Index: -1},
+		},
+		{
+			`{"cmd":"LIVE_OPEN_PLATFORM_SEND_GIFT","data":{"uname":"b","gift_name":"小花花","gift_num":3,"price":100,"paid":true}}`,
+			&model.Task{Command: model.CommandGift, Caller: "b", Content: "小花花", Price: 3, Count: 3},
+		},
+		{
+			`{"cmd":"LIVE_OPEN_PLATFORM_SEND_GIFT","data":{"uname":"b","gift_name":"辣条","gift_num":10,"price":100,"paid":false}}`,
+			&model.Task{Command: model.CommandGift, Caller: "b", Content: "辣条", Price: 0, Count: 10},
+		},
+		{
+			`{"cmd":"LIVE_OPEN_PLATFORM_SUPER_CHAT","data":{"uname":"c","message":"点首系统","rmb":30}}`,
+			&model.Task{Command: model.CommandSuperChat, Caller: "c", Content: "点首系统", Price: 300, Count: 1},
+		},
+		{
+			`{"cmd":"LIVE_OPEN_PLATFORM_GUARD","data":{"user_info":{"uname":"d"},"guard_level":3,"guard_num":1,"price":198000}}`,
+			&model.Task{Command: model.CommandGuard, Caller: "d", Content: "舰长", Price: 1980, Count: 1},
+		},
+		{
+			`{"cmd":"LIVE_OPEN_PLATFORM_LIKE","data":{"uname":"e","like_text":"为主播点赞了","like_count":5}}`,
+			&model.Task{Command: model.CommandLike, Caller: "e", Content: "为主播点赞了", Count: 5},
+		},
+		{
+			`{"cmd":"LIVE_OPEN_PLATFORM_INTERACTION_END","data":{"game_id":"g1"}}`,
+			&model.Task{Command: model.CommandInteractionEnd, Content: "g1"},
+		},
+		{
+			`{"cmd":"LIVE_OPEN_PLATFORM_SUPER_CHAT_DEL","data":{}}`,
+			nil,
+		},
+	} {
+		got, err := parseEvent([]byte(c.raw))
+		if err != nil {
+			t.Fatalf("%s: %v", c.raw, err)
+		}
+		if got != nil && got.Command != model.CommandInteractionEnd {
+			if got.Viewer == nil || got.Viewer.Name != got.Caller {
+				t.Fatalf("%s: expected viewer %s, got %+v", c.raw, got.Caller, got.Viewer)
+			}
+			got.Viewer = nil
+		}
+		if (got == nil) != (c.want == nil) || (got != nil && *got != *c.want) {
+			t.Fatalf("%s: got %+v, want %+v", c.raw, got, c.want)
+		}
+	}
+}
+
+func Test_ParseDanmuViewer(t *testing.T) {
+	raw := `{"cmd":"LIVE_OPEN_PLATFORM_DM","data":{"uname":"a","msg":"点歌 潘","guard_level":3,"fans_medal_level":21,"is_admin":1}}`
+	got, err := parseEvent([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := model.Viewer{Name: "a", GuardLevel: 3, FansMedalLevel: 21, IsAdmin: true}
+	if got.Viewer == nil || *got.Viewer != want {
+		t.Fatalf("got viewer %+v, want %+v", got.Viewer, want)
+	}
+}
+
+func Test_ParseDanmuCommands(t *testing.T) {
+	for _, c := range []struct {
+		msg  string
+		want *model.Task
+	}{
+		{"移动 3 1", &model.Task{Command: model.CommandMove, Caller: "a", Content: "3 1", Index: 2, Target: 0}},
+		{"交换 1 2", &model.Task{Command: model.CommandSwap, Caller: "a", Content: "1 2", Index: 0, Target: 1}},
+		{"置顶 2", &model.Task{Command: model.CommandPin, Caller: "a", Content: "2", Index: 1}},
+		{"清空", &model.Task{Command: model.CommandClear, Caller: "a", Content: "", Index: -1}},
+		{"清空 3", &model.Task{Command: model.CommandClearViewer, Caller: "a", Content: "3", Index: 2}},
+		{"移动 3", &model.Task{Command: model.CommandChat, Caller: "a", Content: "移动 3", Index: -1}},
+		{"别名 834 潘多拉", &model.Task{Command: model.CommandAlias, Caller: "a", Content: "834 潘多拉", Index: -1}},
+		{"别名 PANDORA PARADOXXX 潘", &model.Task{Command: model.CommandAlias, Caller: "a", Content: "PANDORA PARADOXXX 潘", Index: -1}},
+		{"别名 潘", nil},
+		{"查歌 潘", &model.Task{Command: model.CommandSearch, Caller: "a", Content: "潘", Index: -1}},
+		{"查歌", nil},
+		{"随机", &model.Task{Command: model.CommandRandom, Caller: "a", Index: -1}},
+		{"随机 紫 14", &model.Task{Command: model.CommandRandom, Caller: "a", Content: "紫 14", Index: -1}},
+		{"随机应变", &model.Task{Command: model.CommandChat, Caller: "a", Content: "随机应变", Index: -1}},
+		{"随机14", &model.Task{Command: model.CommandChat, Caller: "a", Content: "随机14", Index: -1}},
+	} {
+		got := parseDanmu("a", c.msg)
+		if (got == nil) != (c.want == nil) || (got != nil && *got != *c.want) {
+			t.Fatalf("%s: got %+v, want %+v", c.msg, got, c.want)
+		}
+	}
+}
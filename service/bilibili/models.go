@@ -10,6 +10,16 @@ import (
 const (
 	OpenPlatformHttpHost = "https://live-open.biliapi.com" //开放平台 (线上环境)
 	OpenPlatformDanmuCmd = "LIVE_OPEN_PLATFORM_DM"
+	// 礼物
+	OpenPlatformSendGiftCmd = "LIVE_OPEN_PLATFORM_SEND_GIFT"
+	// 付费留言
+	OpenPlatformSuperChatCmd = "LIVE_OPEN_PLATFORM_SUPER_CHAT"
+	// 大航海
+	OpenPlatformGuardCmd = "LIVE_OPEN_PLATFORM_GUARD"
+	// 点赞
+	OpenPlatformLikeCmd = "LIVE_OPEN_PLATFORM_LIKE"
+	// 场次结束, 之后不会再推送消息
+	OpenPlatformInteractionEndCmd = "LIVE_OPEN_PLATFORM_INTERACTION_END"
 )
 
 type StartAppRequest struct {
@@ -77,7 +87,7 @@ type RespMessage struct {
 		Uname                  string `json:"uname"`
 		Uface                  string `json:"uface"`
 		DmType                 int    `json:"dm_type"`
-		Open                   string `json:"open_"`
+		OpenID                 string `json:"open_id"`
 		IsAdmin                int    `json:"is_admin"`
 		GloryLevel             int    `json:"glory_level"`
 		ReplyOpenID            string `json:"reply_open_id"`
@@ -88,6 +98,105 @@ type RespMessage struct {
 	Cmd string `json:"cmd"`
 }
 
+// RespCmd 只解析 cmd, 用于分发到具体消息类型
+type RespCmd struct {
+	Cmd string `json:"cmd"`
+}
+
+type RespGift struct {
+	Data struct {
+		RoomID                 int    `json:"room_id"`
+		UID                    int    `json:"uid"`
+		OpenID                 string `json:"open_id"`
+		Uname                  string `json:"uname"`
+		Uface                  string `json:"uface"`
+		GiftID                 int    `json:"gift_id"`
+		GiftName               string `json:"gift_name"`
+		GiftNum                int64  `json:"gift_num"`
+		Price                  int64  `json:"price"` // 单价, 1000 = 1元 = 10电池
+		Paid                   bool   `json:"paid"`
+		FansMedalLevel         int    `json:"fans_medal_level"`
+		FansMedalName          string `json:"fans_medal_name"`
+		FansMedalWearingStatus bool   `json:"fans_medal_wearing_status"`
+		GuardLevel             int    `json:"guard_level"`
+		Timestamp              int    `json:"timestamp"`
+		MsgID                  string `json:"msg_id"`
+		GiftIcon               string `json:"gift_icon"`
+		ComboGift              bool   `json:"combo_gift"`
+	} `json:"data"`
+	Cmd string `json:"cmd"`
+}
+
+type RespSuperChat struct {
+	Data struct {
+		RoomID                 int    `json:"room_id"`
+		UID                    int    `json:"uid"`
+		OpenID                 string `json:"open_id"`
+		Uname                  string `json:"uname"`
+		Uface                  string `json:"uface"`
+		MessageID              int64  `json:"message_id"`
+		Message                string `json:"message"`
+		Rmb                    int64  `json:"rmb"` // 元
+		Timestamp              int    `json:"timestamp"`
+		StartTime              int    `json:"start_time"`
+		EndTime                int    `json:"end_time"`
+		GuardLevel             int    `json:"guard_level"`
+		FansMedalLevel         int    `json:"fans_medal_level"`
+		FansMedalName          string `json:"fans_medal_name"`
+		FansMedalWearingStatus bool   `json:"fans_medal_wearing_status"`
+		MsgID                  string `json:"msg_id"`
+	} `json:"data"`
+	Cmd string `json:"cmd"`
+}
+
+type RespGuard struct {
+	Data struct {
+		UserInfo struct {
+			UID    int    `json:"uid"`
+			OpenID string `json:"open_id"`
+			Uname  string `json:"uname"`
+			Uface  string `json:"uface"`
+		} `json:"user_info"`
+		GuardLevel             int    `json:"guard_level"` // 1总督 2提督 3舰长
+		GuardNum               int64  `json:"guard_num"`
+		GuardUnit              string `json:"guard_unit"`
+		Price                  int64  `json:"price"` // 1000 = 1元 = 10电池
+		FansMedalLevel         int    `json:"fans_medal_level"`
+		FansMedalName          string `json:"fans_medal_name"`
+		FansMedalWearingStatus bool   `json:"fans_medal_wearing_status"`
+		RoomID                 int    `json:"room_id"`
+		MsgID                  string `json:"msg_id"`
+		Timestamp              int    `json:"timestamp"`
+	} `json:"data"`
+	Cmd string `json:"cmd"`
+}
+
+type RespLike struct {
+	Data struct {
+		Uname                  string `json:"uname"`
+		UID                    int    `json:"uid"`
+		OpenID                 string `json:"open_id"`
+		Uface                  string `json:"uface"`
+		Timestamp              int    `json:"timestamp"`
+		RoomID                 int    `json:"room_id"`
+		LikeText               string `json:"like_text"`
+		LikeCount              int64  `json:"like_count"`
+		FansMedalWearingStatus bool   `json:"fans_medal_wearing_status"`
+		FansMedalName          string `json:"fans_medal_name"`
+		FansMedalLevel         int    `json:"fans_medal_level"`
+		MsgID                  string `json:"msg_id"`
+	} `json:"data"`
+	Cmd string `json:"cmd"`
+}
+
+type RespInteractionEnd struct {
+	Data struct {
+		GameID    string `json:"game_id"`
+		Timestamp int    `json:"timestamp"`
+	} `json:"data"`
+	Cmd string `json:"cmd"`
+}
+
 const (
 	AcceptHeader              = "Accept"
 	ContentTypeHeader         = "Content-Type"
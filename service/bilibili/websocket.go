@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 	"wolfy/model"
 )
@@ -37,13 +40,26 @@ const (
 	OP_AUTH_REPLY      = int32(8)
 )
 
+const (
+	// HeartbeatTimeout 超过该时间未收到 OP_HEARTBEAT_REPLY 则认为长连已断开
+	HeartbeatTimeout = 30 * time.Second
+	// AuthTimeout 建立长连后超过该时间未鉴权成功则认为长连不可用
+	AuthTimeout = 10 * time.Second
+)
+
 type WebsocketClient struct {
 	conn       *websocket.Conn
 	msgBuf     chan *Proto
 	sequenceId int32
 	dispatcher map[int32]protoLogic
-	authed     bool
+	authed     atomic.Bool
 	taskChan   chan *model.Task
+
+	connectedAt   time.Time
+	lastHeartbeat time.Time
+	closeOnce     sync.Once
+	closed        chan struct{}
+	closeErr      error
 }
 
 type protoLogic func(p *Proto) (err error)
@@ -58,24 +74,64 @@ type Proto struct {
 	BodyMuti     [][]byte
 }
 
+// Encode 按长连协议打包
+func (p *Proto) Encode() []byte {
+	dataBuff := &bytes.Buffer{}
+	packLen := int32(RawHeaderSize + len(p.Body))
+	p.HeaderLength = RawHeaderSize
+	binary.Write(dataBuff, binary.BigEndian, packLen)
+	binary.Write(dataBuff, binary.BigEndian, int16(RawHeaderSize))
+	binary.Write(dataBuff, binary.BigEndian, p.Version)
+	binary.Write(dataBuff, binary.BigEndian, p.Operation)
+	binary.Write(dataBuff, binary.BigEndian, p.SequenceId)
+	binary.Write(dataBuff, binary.BigEndian, p.Body)
+	return dataBuff.Bytes()
+}
+
+// DecodeProto 按长连协议解包
+func DecodeProto(buf []byte) (*Proto, error) {
+	if len(buf) < RawHeaderSize {
+		return nil, fmt.Errorf("proto too short: %d", len(buf))
+	}
+	retProto := &Proto{}
+	retProto.PacketLength = int32(binary.BigEndian.Uint32(buf[PackOffset:HeaderOffset]))
+	retProto.HeaderLength = int16(binary.BigEndian.Uint16(buf[HeaderOffset:VerOffset]))
+	retProto.Version = int16(binary.BigEndian.Uint16(buf[VerOffset:OperationOffset]))
+	retProto.Operation = int32(binary.BigEndian.Uint32(buf[OperationOffset:SeqIdOffset]))
+	retProto.SequenceId = int32(binary.BigEndian.Uint32(buf[SeqIdOffset:]))
+	if retProto.PacketLength < 0 || retProto.PacketLength > MaxPackSize || int(retProto.PacketLength) > len(buf) {
+		return nil, fmt.Errorf("invalid packet length: %d", retProto.PacketLength)
+	}
+	if retProto.HeaderLength != RawHeaderSize {
+		return nil, fmt.Errorf("invalid header length: %d", retProto.HeaderLength)
+	}
+	if bodyLen := int(retProto.PacketLength - int32(retProto.HeaderLength)); bodyLen > 0 {
+		retProto.Body = buf[retProto.HeaderLength:retProto.PacketLength]
+	}
+	retProto.BodyMuti = [][]byte{retProto.Body}
+	return retProto, nil
+}
+
 type AuthRespParam struct {
 	Code int64 `json:"code,omitempty"`
 }
 
-// StartWebsocket 启动长连
-func StartWebsocket(wsAddr, authBody string, taskChan chan *model.Task) (err error) {
+// StartWebsocket 启动长连, 长连断开后 Done 会被关闭, 由调用方负责重连
+func StartWebsocket(wsAddr, authBody string, taskChan chan *model.Task) (wc *WebsocketClient, err error) {
 
 	var conn *websocket.Conn
 	// 建立连接
 	conn, _, err = websocket.DefaultDialer.Dial(wsAddr, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	wc := &WebsocketClient{
-		conn:       conn,
-		msgBuf:     make(chan *Proto, 1024),
-		dispatcher: make(map[int32]protoLogic),
-		taskChan:   taskChan,
+	wc = &WebsocketClient{
+		conn:        conn,
+		msgBuf:      make(chan *Proto, 1024),
+		dispatcher:  make(map[int32]protoLogic),
+		taskChan:    taskChan,
+		connectedAt: time.Now(),
+		closed:      make(chan struct{}),
 	}
 
 	// 注册分发处理函数
@@ -86,7 +142,8 @@ func StartWebsocket(wsAddr, authBody string, taskChan chan *model.Task) (err err
 	// 发送鉴权信息
 	err = wc.sendAuth(authBody)
 	if err != nil {
-		return
+		_ = conn.Close()
+		return nil, err
 	}
 
 	// 读取信息
@@ -98,44 +155,64 @@ func StartWebsocket(wsAddr, authBody string, taskChan chan *model.Task) (err err
 	return
 }
 
+// Authed 是否已鉴权成功
+func (wc *WebsocketClient) Authed() bool {
+	return wc.authed.Load()
+}
+
+// Done 长连断开后关闭
+func (wc *WebsocketClient) Done() <-chan struct{} {
+	return wc.closed
+}
+
+// Err 返回长连断开的原因
+func (wc *WebsocketClient) Err() error {
+	<-wc.closed
+	return wc.closeErr
+}
+
+// Close 关闭长连
+func (wc *WebsocketClient) Close() {
+	wc.closeWithErr(nil)
+}
+
+func (wc *WebsocketClient) closeWithErr(err error) {
+	wc.closeOnce.Do(func() {
+		wc.closeErr = err
+		close(wc.closed)
+		_ = wc.conn.Close()
+	})
+}
+
 // ReadMsg 读取长连信息
 func (wc *WebsocketClient) ReadMsg() {
 	for {
-		retProto := &Proto{}
 		_, buf, err := wc.conn.ReadMessage()
 		if err != nil {
 			log.Println("[WebsocketClient | ReadMsg] err:", err.Error())
-			continue
-		}
-		retProto.PacketLength = int32(binary.BigEndian.Uint32(buf[PackOffset:HeaderOffset]))
-		retProto.HeaderLength = int16(binary.BigEndian.Uint16(buf[HeaderOffset:VerOffset]))
-		retProto.Version = int16(binary.BigEndian.Uint16(buf[VerOffset:OperationOffset]))
-		retProto.Operation = int32(binary.BigEndian.Uint32(buf[OperationOffset:SeqIdOffset]))
-		retProto.SequenceId = int32(binary.BigEndian.Uint32(buf[SeqIdOffset:]))
-		if retProto.PacketLength < 0 || retProto.PacketLength > MaxPackSize {
-			continue
-		}
-		if retProto.HeaderLength != RawHeaderSize {
-			continue
+			wc.closeWithErr(err)
+			return
 		}
-		if bodyLen := int(retProto.PacketLength - int32(retProto.HeaderLength)); bodyLen > 0 {
-			retProto.Body = buf[retProto.HeaderLength:retProto.PacketLength]
-		} else {
+		retProto, err := DecodeProto(buf)
+		if err != nil {
 			continue
 		}
-		retProto.BodyMuti = [][]byte{retProto.Body}
-		if len(retProto.BodyMuti) > 0 {
-			retProto.Body = retProto.BodyMuti[0]
+		select {
+		case wc.msgBuf <- retProto:
+		case <-wc.closed:
+			return
 		}
-		wc.msgBuf <- retProto
 	}
 }
 
 // DoEvent 处理信息
 func (wc *WebsocketClient) DoEvent() {
 	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-wc.closed:
+			return
 		case p := <-wc.msgBuf:
 			if p == nil {
 				continue
@@ -148,11 +225,30 @@ func (wc *WebsocketClient) DoEvent() {
 				continue
 			}
 		case <-ticker.C:
+			if err := wc.checkAlive(); err != nil {
+				log.Println("[WebsocketClient | DoEvent] connection dead:", err.Error())
+				wc.closeWithErr(err)
+				return
+			}
 			wc.sendHeartBeat()
 		}
 	}
 }
 
+// checkAlive 检查鉴权与心跳回复是否超时
+func (wc *WebsocketClient) checkAlive() error {
+	if !wc.authed.Load() {
+		if time.Since(wc.connectedAt) > AuthTimeout {
+			return fmt.Errorf("auth reply timeout")
+		}
+		return nil
+	}
+	if time.Since(wc.lastHeartbeat) > HeartbeatTimeout {
+		return fmt.Errorf("heartbeat reply timeout, last at %v", wc.lastHeartbeat)
+	}
+	return nil
+}
+
 // sendAuth 发送鉴权
 func (wc *WebsocketClient) sendAuth(authBody string) (err error) {
 	p := &Proto{
@@ -164,7 +260,7 @@ func (wc *WebsocketClient) sendAuth(authBody string) (err error) {
 
 // sendHeartBeat 发送心跳
 func (wc *WebsocketClient) sendHeartBeat() {
-	if !wc.authed {
+	if !wc.authed.Load() {
 		return
 	}
 	msg := &Proto{}
@@ -180,16 +276,7 @@ func (wc *WebsocketClient) sendHeartBeat() {
 
 // sendMsg 发送信息
 func (wc *WebsocketClient) sendMsg(msg *Proto) (err error) {
-	dataBuff := &bytes.Buffer{}
-	packLen := int32(RawHeaderSize + len(msg.Body))
-	msg.HeaderLength = RawHeaderSize
-	binary.Write(dataBuff, binary.BigEndian, packLen)
-	binary.Write(dataBuff, binary.BigEndian, int16(RawHeaderSize))
-	binary.Write(dataBuff, binary.BigEndian, msg.Version)
-	binary.Write(dataBuff, binary.BigEndian, msg.Operation)
-	binary.Write(dataBuff, binary.BigEndian, msg.SequenceId)
-	binary.Write(dataBuff, binary.BigEndian, msg.Body)
-	err = wc.conn.WriteMessage(websocket.BinaryMessage, dataBuff.Bytes())
+	err = wc.conn.WriteMessage(websocket.BinaryMessage, msg.Encode())
 	if err != nil {
 		log.Println("[WebsocketClient | sendMsg] send msg err:", msg)
 		return
@@ -202,18 +289,23 @@ func (wc *WebsocketClient) authResp(msg *Proto) (err error) {
 	resp := &AuthRespParam{}
 	err = json.Unmarshal(msg.Body, resp)
 	if err != nil {
+		wc.closeWithErr(fmt.Errorf("auth reply unmarshal err: %v", err))
 		return
 	}
 	if resp.Code != 0 {
+		err = fmt.Errorf("auth failed, code %d", resp.Code)
+		wc.closeWithErr(err)
 		return
 	}
-	wc.authed = true
+	wc.authed.Store(true)
+	wc.lastHeartbeat = time.Now()
 	log.Println("[WebsocketClient | authResp] auth success")
 	return
 }
 
 // heartBeatResp  心跳结果
 func (wc *WebsocketClient) heartBeatResp(msg *Proto) (err error) {
+	wc.lastHeartbeat = time.Now()
 	log.Println("[WebsocketClient | heartBeatResp] get HeartBeat resp", msg.Body)
 	return
 }
@@ -223,24 +315,22 @@ func (wc *WebsocketClient) msgResp(msg *Proto) (err error) {
 	for index, cmd := range msg.BodyMuti {
 		log.Printf("[WebsocketClient | msgResp] recv MsgResp "+
 			"index:%d ver:%d cmd:%s", index, msg.Version, string(cmd))
-		var r RespMessage
-		err = json.Unmarshal(cmd, &r)
+		var task *model.Task
+		task, err = parseEvent(cmd)
 		if err != nil {
+			log.Println("[WebsocketClient | msgResp] parse err:", err.Error())
 			continue
 		}
-		if wc.taskChan == nil {
+		if task == nil || wc.taskChan == nil {
 			continue
 		}
-		var task *model.Task
-		if r.Cmd == OpenPlatformDanmuCmd {
-			log.Println(r)
-			task = parseDanmu(r.Data.Uname, r.Data.Msg)
-			log.Println(task)
-			if task == nil {
-				continue
-			}
-		}
+		log.Println(task)
 		wc.taskChan <- task
+		if task.Command == model.CommandInteractionEnd {
+			// 场次已被平台结束, 断开后由 AppService 重新开启场次
+			wc.closeWithErr(fmt.Errorf("interaction end, game %s", task.Content))
+			return nil
+		}
 	}
 	return
 }
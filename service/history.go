@@ -0,0 +1,295 @@
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	HistoryStatusFinished  = "finished"
+	HistoryStatusCancelled = "cancelled"
+	HistoryStatusCleared   = "cleared"
+)
+
+// HistoryEntry 一首关闭的点歌, 由主播或房管关闭的记为 finished, 点歌者自己删除的记为 cancelled,
+// 清空歌单或清空某位观众的点歌时记为 cleared
+type HistoryEntry struct {
+	SessionID   string    `json:"session_id"`
+	SongID      int       `json:"song_id"`
+	Title       string    `json:"title"`
+	Keyword     string    `json:"keyword"`
+	Creator     string    `json:"creator"`
+	CreatorID   string    `json:"creator_id"`
+	Type        string    `json:"type"`
+	Difficulty  string    `json:"difficulty"`
+	Level       string    `json:"level"`
+	Price       int64     `json:"price"`
+	Status      string    `json:"status"`
+	RequestedAt time.Time `json:"requested_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+}
+
+type HistorySession struct {
+	ID        string    `json:"id"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	Count     int       `json:"count"`
+}
+
+type SongCount struct {
+	SongID int    `json:"song_id"`
+	Title  string `json:"title"`
+	Count  int    `json:"count"`
+}
+
+type RequesterCount struct {
+	CreatorID string `json:"creator_id"`
+	Creator   string `json:"creator"`
+	Count     int    `json:"count"`
+}
+
+type HistoryStats struct {
+	Total         int              `json:"total"`
+	Finished      int              `json:"finished"`
+	Cancelled     int              `json:"cancelled"`
+	Cleared       int              `json:"cleared"`
+	TopSongs      []SongCount      `json:"top_songs"`
+	TopRequesters []RequesterCount `json:"top_requesters"`
+	// AverageWait 已演奏歌曲从点歌到关闭的平均等待秒数
+	AverageWait float64 `json:"average_wait"`
+}
+
+// History 持久化的点歌历史, 按场次分组; 一次运行中断线重连换了开放平台场次id也归入同一场次
+type History struct {
+	lock     sync.RWMutex
+	path     string
+	session  string
+	sessions []*HistorySession
+	entries  []*HistoryEntry
+}
+
+// historyFile 历史文件的格式, 旧版本的文件只有 entries 数组
+type historyFile struct {
+	Sessions []*HistorySession `json:"sessions"`
+	Entries  []*HistoryEntry   `json:"entries"`
+}
+
+// NewHistory path 为空时只保存在内存中
+func NewHistory(path string) *History {
+	h := &History{
+		path: path,
+	}
+	if err := h.load(); err != nil {
+		h.entries = make([]*HistoryEntry, 0)
+		if err = h.save(); err != nil {
+			panic(err)
+		}
+	}
+	return h
+}
+
+func (h *History) load() error {
+	if h.path == "" {
+		return nil
+	}
+
+	file, err := os.ReadFile(h.path)
+	if err != nil {
+		return err
+	}
+	var content historyFile
+	if err = json.Unmarshal(file, &content); err != nil {
+		var entries []*HistoryEntry
+		if json.Unmarshal(file, &entries) != nil {
+			return err
+		}
+		content.Entries = entries
+	}
+	h.sessions = content.Sessions
+	h.entries = content.Entries
+	if h.entries == nil {
+		h.entries = make([]*HistoryEntry, 0)
+	}
+	return nil
+}
+
+func (h *History) save() error {
+	if h.path == "" {
+		return nil
+	}
+
+	result, err := json.Marshal(&historyFile{Sessions: h.sessions, Entries: h.entries})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(h.path, result, 0644)
+}
+
+// SetSession 开始新的场次, 之后的记录都归入该场次; 当前场次还没有结束时视为断线重连, 保持原场次
+func (h *History) SetSession(sessionID string, startedAt time.Time) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.session != "" {
+		return nil
+	}
+	h.session = sessionID
+	h.sessions = append(h.sessions, &HistorySession{ID: sessionID, StartedAt: startedAt})
+	return h.save()
+}
+
+// EndSession 结束当前场次, 退出时调用
+func (h *History) EndSession(endedAt time.Time) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.session == "" {
+		return nil
+	}
+	for _, session := range h.sessions {
+		if session.ID == h.session {
+			session.EndedAt = endedAt
+		}
+	}
+	h.session = ""
+	return h.save()
+}
+
+// Record 记录关闭的点歌并写入文件
+func (h *History) Record(entries ...*HistoryEntry) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, entry := range entries {
+		entry.SessionID = h.session
+		h.entries = append(h.entries, entry)
+	}
+	return h.save()
+}
+
+// Entries 返回某个场次的记录, sessionID 为空时返回全部
+func (h *History) Entries(sessionID string) []HistoryEntry {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	result := make([]HistoryEntry, 0)
+	for _, entry := range h.entries {
+		if sessionID == "" || entry.SessionID == sessionID {
+			result = append(result, *entry)
+		}
+	}
+	return result
+}
+
+// LastPlayed 歌曲最近一次演奏完成的时间, 没有演奏过时为零值
+func (h *History) LastPlayed(songID int) time.Time {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	var last time.Time
+	for _, entry := range h.entries {
+		if entry.SongID == songID && entry.Status == HistoryStatusFinished && entry.FinishedAt.After(last) {
+			last = entry.FinishedAt
+		}
+	}
+	return last
+}
+
+// Sessions 按开始时间排列的场次; 旧版本没有记录开始时间的场次以最早的点歌时间为准
+func (h *History) Sessions() []HistorySession {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	result := make([]HistorySession, 0, len(h.sessions))
+	index := map[string]int{}
+	for _, session := range h.sessions {
+		index[session.ID] = len(result)
+		result = append(result, HistorySession{ID: session.ID, StartedAt: session.StartedAt, EndedAt: session.EndedAt})
+	}
+	for _, entry := range h.entries {
+		started := entry.RequestedAt
+		if started.IsZero() {
+			started = entry.FinishedAt
+		}
+		i, ok := index[entry.SessionID]
+		if !ok {
+			i = len(result)
+			index[entry.SessionID] = i
+			result = append(result, HistorySession{ID: entry.SessionID, StartedAt: started})
+		}
+		session := &result[i]
+		session.Count++
+		if i >= len(h.sessions) && started.Before(session.StartedAt) {
+			session.StartedAt = started
+		}
+		if entry.FinishedAt.After(session.EndedAt) {
+			session.EndedAt = entry.FinishedAt
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].StartedAt.Before(result[j].StartedAt)
+	})
+	return result
+}
+
+// Stats 统计某个场次点歌最多的歌曲与观众, sessionID 为空时统计全部
+func (h *History) Stats(sessionID string, top int) *HistoryStats {
+	entries := h.Entries(sessionID)
+	stats := &HistoryStats{
+		Total:         len(entries),
+		TopSongs:      make([]SongCount, 0),
+		TopRequesters: make([]RequesterCount, 0),
+	}
+	songs := map[int]int{}
+	requesters := map[string]int{}
+	var wait time.Duration
+	var waited int
+	for _, entry := range entries {
+		if i, ok := songs[entry.SongID]; ok {
+			stats.TopSongs[i].Count++
+		} else {
+			songs[entry.SongID] = len(stats.TopSongs)
+			stats.TopSongs = append(stats.TopSongs, SongCount{SongID: entry.SongID, Title: entry.Title, Count: 1})
+		}
+		requester := entry.CreatorID
+		if requester == "" {
+			requester = "name:" + entry.Creator
+		}
+		if i, ok := requesters[requester]; ok {
+			stats.TopRequesters[i].Count++
+			stats.TopRequesters[i].Creator = entry.Creator
+		} else {
+			requesters[requester] = len(stats.TopRequesters)
+			stats.TopRequesters = append(stats.TopRequesters,
+				RequesterCount{CreatorID: entry.CreatorID, Creator: entry.Creator, Count: 1})
+		}
+
+		switch entry.Status {
+		case HistoryStatusCleared:
+			stats.Cleared++
+			continue
+		case HistoryStatusCancelled:
+			stats.Cancelled++
+			continue
+		}
+		stats.Finished++
+		if !entry.RequestedAt.IsZero() {
+			wait += entry.FinishedAt.Sub(entry.RequestedAt)
+			waited++
+		}
+	}
+	if waited > 0 {
+		stats.AverageWait = wait.Seconds() / float64(waited)
+	}
+
+	sort.SliceStable(stats.TopSongs, func(i, j int) bool {
+		return stats.TopSongs[i].Count > stats.TopSongs[j].Count
+	})
+	sort.SliceStable(stats.TopRequesters, func(i, j int) bool {
+		return stats.TopRequesters[i].Count > stats.TopRequesters[j].Count
+	})
+	if top > 0 && len(stats.TopSongs) > top {
+		stats.TopSongs = stats.TopSongs[:top]
+	}
+	if top > 0 && len(stats.TopRequesters) > top {
+		stats.TopRequesters = stats.TopRequesters[:top]
+	}
+	return stats
+}
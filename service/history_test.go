@@ -0,0 +1,112 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"wolfy/model"
+)
+
+func Test_FinishedTicketsAreRecorded(t *testing.T) {
+	master := newTestTicketMaster(12, TicketPolicy{})
+	now := time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)
+	master.now = func() time.Time { return now }
+	anchor := &model.Viewer{OpenID: "open-anchor", Name: "主播", Role: model.RoleAnchor}
+
+	if err := master.history.SetSession("game-1", now); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ creator, keyword string }{{"a", "系统"}, {"b", "潘"}, {"a", "Oshama"}} {
+		if _, err := master.AddTicket(&model.Viewer{OpenID: "open-" + c.creator, Name: c.creator}, c.keyword); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = now.Add(10 * time.Minute)
+	if _, err := master.FinishTicket(anchor, 0); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(10 * time.Minute)
+	if _, err := master.FinishTicket(anchor, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// 断线重连换了场次id, 仍然归入原场次
+	if err := master.history.SetSession("game-1-reconnect", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := master.history.EndSession(now); err != nil {
+		t.Fatal(err)
+	}
+	gameTwo := now.Add(time.Minute)
+	if err := master.history.SetSession("game-2", gameTwo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.FinishTicket(&model.Viewer{OpenID: "open-a", Name: "a"}, -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.AddTicket(&model.Viewer{OpenID: "open-a", Name: "a"}, "系统"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(30 * time.Minute)
+	if _, err := master.FinishTicket(anchor, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := master.history.Entries("game-1")
+	if len(entries) != 2 || entries[0].Title != "系ぎて" || entries[0].Level != "14.5" || entries[0].Status != HistoryStatusFinished {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	// 清空的点歌单独记录
+	for _, keyword := range []string{"潘", "QZKago"} {
+		if _, err := master.AddTicket(&model.Viewer{OpenID: "open-b", Name: "b"}, keyword); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := master.ClearTickets(anchor); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := master.history.Sessions()
+	if len(sessions) != 2 || sessions[0].ID != "game-1" || sessions[1].Count != 4 {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+	if !sessions[0].StartedAt.Equal(time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)) || !sessions[1].StartedAt.Equal(gameTwo) {
+		t.Fatalf("expected sessions to start when they were opened, got %+v", sessions)
+	}
+
+	stats := master.history.Stats("", 1)
+	if stats.Total != 6 || stats.Finished != 3 || stats.Cancelled != 1 || stats.Cleared != 2 {
+		t.Fatalf("unexpected counts %+v", stats)
+	}
+	if len(stats.TopSongs) != 1 || stats.TopSongs[0].Title != "系ぎて" || stats.TopSongs[0].Count != 2 {
+		t.Fatalf("unexpected top songs %+v", stats.TopSongs)
+	}
+	if len(stats.TopRequesters) != 1 || stats.TopRequesters[0].CreatorID != "open-a" {
+		t.Fatalf("unexpected top requesters %+v", stats.TopRequesters)
+	}
+	if stats.AverageWait != (20 * time.Minute).Seconds() {
+		t.Fatalf("unexpected average wait %v", stats.AverageWait)
+	}
+}
+
+func Test_LegacyHistoryFileLoads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	legacy := `[{"session_id":"game-1","song_id":1,"status":"finished",` +
+		`"requested_at":"2024-01-01T20:00:00Z","finished_at":"2024-01-01T20:10:00Z"}]`
+	if err := os.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	history := NewHistory(path)
+	sessions := history.Sessions()
+	if len(sessions) != 1 || !sessions[0].StartedAt.Equal(time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+
+	if err := history.SetSession("game-2", time.Date(2024, 1, 2, 20, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if sessions = NewHistory(path).Sessions(); len(sessions) != 2 || sessions[1].ID != "game-2" {
+		t.Fatalf("expected session to be saved, got %+v", sessions)
+	}
+}
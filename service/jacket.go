@@ -0,0 +1,162 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultJacketCacheDir 封面缩略图的缓存目录
+	DefaultJacketCacheDir = "./runtime/jackets"
+	// DefaultJacketSize 缩略图的最大边长
+	DefaultJacketSize = 200
+)
+
+// jacketExtensions 可以作为封面原图的格式
+var jacketExtensions = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".webp": true}
+
+// JacketStore 本地封面, 在图片目录中按 Music.xml 的 jacketFile 或歌曲id找到原图, 缩放为 PNG 缩略图缓存到 CacheDir;
+// 不读取游戏数据中的 .ab 资源包, 图片目录需要是已经导出的封面, 如 UI_Jacket_000834.png 或 834.png
+type JacketStore struct {
+	Dirs     []string
+	CacheDir string
+	Size     int
+
+	lock sync.Mutex
+	// sources 小写的文件名 (不含扩展名) 对应的原图
+	sources map[string]string
+}
+
+func NewJacketStore(dirs []string, cacheDir string) *JacketStore {
+	store := &JacketStore{Dirs: dirs, CacheDir: cacheDir, Size: DefaultJacketSize}
+	if err := store.Scan(); err != nil {
+		log.Printf("failed to scan jackets: %v", err)
+	}
+	return store
+}
+
+// Scan 重新索引各目录中的图片, 目录不存在时跳过
+func (j *JacketStore) Scan() error {
+	sources := map[string]string{}
+	for _, dir := range j.Dirs {
+		if _, err := os.Stat(dir); err != nil {
+			log.Printf("jacket dir %s skipped: %v", dir, err)
+			continue
+		}
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			ext := strings.ToLower(filepath.Ext(d.Name()))
+			if d.IsDir() || !jacketExtensions[ext] {
+				return nil
+			}
+			// 后面的目录优先, 与曲库目录的顺序一致
+			sources[strings.ToLower(strings.TrimSuffix(d.Name(), filepath.Ext(d.Name())))] = path
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	j.lock.Lock()
+	j.sources = sources
+	j.lock.Unlock()
+	log.Println("Jackets found:", len(sources))
+	return nil
+}
+
+// source 歌曲封面的原图, 依次按 jacketFile、UI_Jacket_000834、000834、834 查找
+func (j *JacketStore) source(record *MaimaiRecord) string {
+	id := normalizeSongID(record.ID)
+	names := []string{
+		fmt.Sprintf("ui_jacket_%06d", id),
+		fmt.Sprintf("%06d", id),
+		strconv.Itoa(id),
+	}
+	if record.Jacket != "" {
+		names = append([]string{strings.ToLower(record.Jacket)}, names...)
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for _, name := range names {
+		if path, ok := j.sources[name]; ok {
+			return path
+		}
+	}
+	return ""
+}
+
+// Has 本地是否有该歌曲的封面
+func (j *JacketStore) Has(record *MaimaiRecord) bool {
+	return j.source(record) != ""
+}
+
+// Thumbnail 返回缩略图的路径, 没有缓存或原图更新过时重新生成
+func (j *JacketStore) Thumbnail(record *MaimaiRecord) (string, error) {
+	source := j.source(record)
+	if source == "" {
+		return "", fmt.Errorf("no local jacket for %d", record.ID)
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(j.CacheDir, strconv.Itoa(songKey(record.ID))+".png")
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if cached, err := os.Stat(path); err == nil && !cached.ModTime().Before(info.ModTime()) {
+		return path, nil
+	}
+	content, err := os.ReadFile(source)
+	if err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode jacket %s: %v", source, err)
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, scaleToFit(img, j.Size)); err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(j.CacheDir, 0755); err != nil {
+		return "", err
+	}
+	if err = writeFileAtomic(path, buf.Bytes()); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// scaleToFit 等比缩小到边长不超过 size, 不放大
+func scaleToFit(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if size <= 0 || (width <= size && height <= size) {
+		return img
+	}
+	if width >= height {
+		height = max(1, height*size/width)
+		width = size
+	} else {
+		width = max(1, width*size/height)
+		height = size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
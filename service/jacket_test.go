@@ -0,0 +1,102 @@
+package service
+
+import (
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestImage(t *testing.T, path string, width, height int) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	if filepath.Ext(path) == ".jpg" {
+		err = jpeg.Encode(file, img, nil)
+	} else {
+		err = png.Encode(file, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func decodeTestImage(t *testing.T, path string) image.Image {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func Test_JacketStore(t *testing.T) {
+	root := t.TempDir()
+	writeTestImage(t, filepath.Join(root, "package", "A000", "jacket", "UI_Jacket_000834.png"), 400, 300)
+	writeTestImage(t, filepath.Join(root, "images", "1000.jpg"), 100, 100)
+	store := NewJacketStore([]string{filepath.Join(root, "package"), filepath.Join(root, "images"), filepath.Join(root, "missing")},
+		filepath.Join(root, "runtime", "jackets"))
+
+	// 按 jacketFile 查找, 缩小并保持比例
+	pandora := &MaimaiRecord{ID: 10834, Jacket: "UI_Jacket_000834"}
+	path, err := store.Thumbnail(pandora)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decodeTestImage(t, path).Bounds(); got.Dx() != 200 || got.Dy() != 150 {
+		t.Fatalf("expected 200x150 thumbnail, got %v", got)
+	}
+
+	// 按歌曲id查找, 小图不放大
+	extra := &MaimaiRecord{ID: 11000}
+	path, err = store.Thumbnail(extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decodeTestImage(t, path).Bounds(); got.Dx() != 100 || filepath.Base(path) != "1000.png" {
+		t.Fatalf("expected unscaled thumbnail 1000.png, got %v %s", got, path)
+	}
+
+	if store.Has(&MaimaiRecord{ID: 8}) {
+		t.Fatal("expected no local jacket")
+	}
+	if _, err = store.Thumbnail(&MaimaiRecord{ID: 8}); err == nil {
+		t.Fatal("expected error without local jacket")
+	}
+
+	// 原图没有更新时使用缓存
+	cached := filepath.Join(root, "runtime", "jackets", "834.png")
+	if err = os.WriteFile(cached, []byte("cached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Thumbnail(pandora); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(cached); string(content) != "cached" {
+		t.Fatal("expected cached thumbnail to be reused")
+	}
+	source := filepath.Join(root, "package", "A000", "jacket", "UI_Jacket_000834.png")
+	later := time.Now().Add(time.Hour)
+	if err = os.Chtimes(source, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Thumbnail(pandora); err != nil {
+		t.Fatal(err)
+	}
+	decodeTestImage(t, cached)
+}
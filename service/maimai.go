@@ -5,9 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"wolfy/model"
 )
 
@@ -19,10 +23,28 @@ type Alias struct {
 	Aliases []string `json:"aliases"`
 }
 
+// clone 深拷贝, 别名列表不与原列表共享
+func (a *Aliases) clone() *Aliases {
+	if a == nil {
+		return nil
+	}
+	result := &Aliases{Alias: make([]Alias, len(a.Alias))}
+	for i, alias := range a.Alias {
+		result.Alias[i] = Alias{SongID: alias.SongID, Aliases: append([]string(nil), alias.Aliases...)}
+	}
+	return result
+}
+
 type MaimaiLevel struct {
 	Type       string `json:"type"`
 	Difficulty string `json:"difficulty"`
 	Level      string `json:"level"`
+	// Constant 定数, songs.json 中没有
+	Constant float64 `json:"constant,omitempty"`
+	// Charter 谱面作者
+	Charter string `json:"charter,omitempty"`
+	// Notes 物量
+	Notes int `json:"notes,omitempty"`
 }
 
 type MaimaiRecord struct {
@@ -31,26 +53,91 @@ type MaimaiRecord struct {
 	ImagePath string        `json:"image"`
 	Levels    []MaimaiLevel `json:"levels"`
 	Category  string        `json:"category"`
+	Artist    string        `json:"artist,omitempty"`
+	BPM       int           `json:"bpm,omitempty"`
+	Version   string        `json:"version,omitempty"`
+	// Locked 需要活动解锁的歌曲, 只有游戏数据提供
+	Locked bool `json:"locked,omitempty"`
+	// Jacket 游戏数据中的封面文件名, 如 UI_Jacket_000834
+	Jacket string `json:"jacket,omitempty"`
+}
+
+func (r *MaimaiRecord) hasChartType(chartType string) bool {
+	for _, level := range r.Levels {
+		if level.Type == chartType {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUtage 只有宴会场谱面的歌曲
+func (r *MaimaiRecord) IsUtage() bool {
+	for _, level := range r.Levels {
+		if level.Type != "宴" {
+			return false
+		}
+	}
+	return len(r.Levels) > 0
+}
+
+// track MaimaiTicket.Level 对应的谱面
+func (r *MaimaiRecord) track(level int) *MaimaiLevel {
+	return &r.Levels[(2*len(r.Levels)-1-level)%len(r.Levels)]
 }
 
 func (r *MaimaiRecord) GetTrackType(level int) string {
-	return r.Levels[(2*len(r.Levels)-1-level)%len(r.Levels)].Type
+	return r.track(level).Type
 }
 
 func (r *MaimaiRecord) GetTrackLevel(level int) string {
-	return r.Levels[(2*len(r.Levels)-1-level)%len(r.Levels)].Level
+	return r.track(level).Level
 }
 
 func (r *MaimaiRecord) GetTrackDifficulty(level int) string {
-	return r.Levels[(2*len(r.Levels)-1-level)%len(r.Levels)].Difficulty
+	return r.track(level).Difficulty
 }
 
 type MaimaiTicket struct {
-	Keyword string        `json:"keyword"`
-	Creator string        `json:"creator"`
-	Record  *MaimaiRecord `json:"record"`
-	Rank    int           `json:"rank"`
-	Level   int           `json:"level"`
+	Keyword string `json:"keyword"`
+	Creator string `json:"creator"`
+	// CreatorID 点歌者的 open_id, 旧检查点中为空
+	CreatorID string        `json:"creator_id"`
+	Record    *MaimaiRecord `json:"record"`
+	Rank      int           `json:"rank"`
+	Level     int           `json:"level"`
+	// Price 付费点歌的电池数, 免费点歌为 0
+	Price int64 `json:"price"`
+	// Pinned 正在演奏, 固定在歌单顶部, 付费点歌也排在其后
+	Pinned bool `json:"pinned"`
+	// CreatedAt 点歌时间, 旧检查点中为零值
+	CreatedAt time.Time `json:"created_at"`
+	// Query 点歌时指定的谱面条件, 没有条件时为空
+	Query *PickQuery `json:"query,omitempty"`
+	// Random 随机点歌, 换歌时重新随机
+	Random bool `json:"random,omitempty"`
+}
+
+// query 点歌条件, 没有指定条件时只按关键词匹配
+func (m *MaimaiTicket) query() PickQuery {
+	if m.Query == nil {
+		return PickQuery{Keyword: m.Keyword}
+	}
+	return *m.Query
+}
+
+// pick 换成满足条件的第 rank 个匹配结果, 有谱面条件时同时选中满足条件的谱面
+func (m *MaimaiTicket) pick(storage *MaimaiStorage, rank int) error {
+	query := m.query()
+	record, err := storage.Pick(query, rank)
+	if err != nil {
+		return err
+	}
+	m.Record, m.Rank = record, rank
+	if query.HasFilter() {
+		m.Level = query.ticketLevel(record)
+	}
+	return nil
 }
 
 func (m *MaimaiTicket) RotateLevel() {
@@ -65,6 +152,11 @@ func (m *MaimaiTicket) GetCoverPath() string {
 	return m.Record.ImagePath
 }
 
+// GetSongID 曲库中歌曲的键, 用于查找本地封面
+func (m *MaimaiTicket) GetSongID() int {
+	return songKey(m.Record.ID)
+}
+
 func (m *MaimaiTicket) GetCoverInfo() string {
 	return m.Record.GetTrackType(m.Level)
 }
@@ -77,6 +169,26 @@ func (m *MaimaiTicket) GetSongInfo() string {
 	return m.Record.GetTrackLevel(m.Level) + "_" + m.Record.GetTrackDifficulty(m.Level)
 }
 
+func (m *MaimaiTicket) GetArtist() string {
+	return m.Record.Artist
+}
+
+func (m *MaimaiTicket) GetBPM() int {
+	return m.Record.BPM
+}
+
+func (m *MaimaiTicket) GetVersion() string {
+	return m.Record.Version
+}
+
+func (m *MaimaiTicket) GetCharter() string {
+	return m.Record.track(m.Level).Charter
+}
+
+func (m *MaimaiTicket) GetNotes() int {
+	return m.Record.track(m.Level).Notes
+}
+
 func (m *MaimaiTicket) GetTitle() string {
 	return m.Record.Title
 }
@@ -85,6 +197,14 @@ func (m *MaimaiTicket) GetCreator() string {
 	return m.Creator
 }
 
+func (m *MaimaiTicket) GetPrice() int64 {
+	return m.Price
+}
+
+func (m *MaimaiTicket) IsPinned() bool {
+	return m.Pinned
+}
+
 type MaimaiTicketMaster struct {
 	lock    sync.RWMutex
 	tickets []*MaimaiTicket
@@ -92,117 +212,347 @@ type MaimaiTicketMaster struct {
 	maxTicketSize  int
 	checkPointPath string
 	storage        *MaimaiStorage
+	policy         TicketPolicy
+	history        *History
+
+	usages map[string]*pickUsage
+	// pending 等待观众确认的低匹配度点歌, 以观众id为键
+	pending map[string]*pendingPick
+	now     func() time.Time
+	// intn 随机点歌使用的随机数, 返回 [0, n)
+	intn func(n int) int
+}
+
+// pendingPick 匹配度过低时列出的候选, 观众发送序号确认
+type pendingPick struct {
+	keyword    string
+	candidates []SearchCandidate
+	expires    time.Time
+	// price 付费点歌的金额, 确认后按付费点歌插入
+	price int64
 }
 
 const (
-	superAdmin = "主播"
+	// disambiguationSize 匹配度过低时列出的候选数
+	disambiguationSize = 3
+	// randomKeyword 随机点歌的关键词
+	randomKeyword = "随机"
+	// randomReplayWindow 随机点歌不会选到该时间内演奏过的歌曲, ReplayCooldown 更长时以其为准
+	randomReplayWindow = 2 * time.Hour
 )
 
-func (t *MaimaiTicketMaster) checkPermission(creator string, index int64) bool {
-	if index >= int64(len(t.tickets)) {
+var ErrPaidBelowThreshold = errors.New("未达到付费点歌金额")
+
+// owns 观众是否为点歌者; 旧检查点中没有 CreatorID 的点歌不能按昵称认领, 只有房管及以上可以操作
+func (m *MaimaiTicket) owns(viewer *model.Viewer) bool {
+	return m.CreatorID != "" && m.CreatorID == viewer.ID()
+}
+
+// sameCreator 两首是否由同一位观众点的, 旧存档按昵称比较
+func (m *MaimaiTicket) sameCreator(other *MaimaiTicket) bool {
+	if m.CreatorID == "" || other.CreatorID == "" {
+		return m.CreatorID == other.CreatorID && m.Creator == other.Creator
+	}
+	return m.CreatorID == other.CreatorID
+}
+
+func (m *MaimaiTicket) historyEntry(status string, finishedAt time.Time) *HistoryEntry {
+	return &HistoryEntry{
+		SongID:      m.Record.ID,
+		Title:       m.Record.Title,
+		Keyword:     m.Keyword,
+		Creator:     m.Creator,
+		CreatorID:   m.CreatorID,
+		Type:        m.Record.GetTrackType(m.Level),
+		Difficulty:  m.Record.GetTrackDifficulty(m.Level),
+		Level:       m.Record.GetTrackLevel(m.Level),
+		Price:       m.Price,
+		Status:      status,
+		RequestedAt: m.CreatedAt,
+		FinishedAt:  finishedAt,
+	}
+}
+
+func (t *MaimaiTicketMaster) checkPermission(operator *model.Viewer, index int64) bool {
+	if index < 0 || index >= int64(len(t.tickets)) {
 		return false
 	}
-	return t.tickets[index].Creator == creator || creator == superAdmin
+	return t.tickets[index].owns(operator) || operator.Elevated()
 }
 
-func (t *MaimaiTicketMaster) FinishTicket(operator string, index int64) (string, error) {
-	t.lock.Lock()
-	defer t.lock.Unlock()
-	if index >= int64(len(t.tickets)) {
-		return "", fmt.Errorf("%s 编号错误", operator)
+// locate 校验编号与权限, index 为 -1 时取操作者点的第一首
+func (t *MaimaiTicketMaster) locate(operator *model.Viewer, index int64) (int64, error) {
+	if index < -1 || index >= int64(len(t.tickets)) {
+		return 0, fmt.Errorf("%s 编号错误", operator.Name)
 	}
 	if index == -1 {
 		for i, ticket := range t.tickets {
-			if ticket.Creator == operator {
+			if ticket.owns(operator) {
 				index = int64(i)
 				break
 			}
 		}
+		if index == -1 {
+			return 0, fmt.Errorf("%s 还没有点歌", operator.Name)
+		}
 	}
 
 	if !t.checkPermission(operator, index) {
-		return "", fmt.Errorf("%s 只能操作自己点的歌曲", operator)
+		return 0, fmt.Errorf("%s 只能操作自己点的歌曲", operator.Name)
+	}
+	// 点歌者改名后同步昵称
+	if ticket := t.tickets[index]; ticket.owns(operator) {
+		ticket.Creator = operator.Name
+	}
+	return index, nil
+}
+
+func (t *MaimaiTicketMaster) FinishTicket(operator *model.Viewer, index int64) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	index, err := t.locate(operator, index)
+	if err != nil {
+		return "", err
 	}
+	ticket := t.tickets[index]
 	t.tickets = append(t.tickets[:index], t.tickets[index+1:]...)
-	err := t.saveCheckPoint()
+	err = t.saveCheckPoint()
 	if err != nil {
 		log.Fatalf("failed to save ticket check point %v", err)
 		return "", err
 	}
+	status := HistoryStatusCancelled
+	if operator.Elevated() {
+		status = HistoryStatusFinished
+	}
+	t.recordHistory(status, ticket)
 	return "关闭成功", nil
 }
 
-func (t *MaimaiTicketMaster) NextRank(operator string, index int64) (string, error) {
+func (t *MaimaiTicketMaster) NextRank(operator *model.Viewer, index int64) (string, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	if index >= int64(len(t.tickets)) {
-		return "", fmt.Errorf("%s 编号错误", operator)
-	}
-	if index == -1 {
-		for i, ticket := range t.tickets {
-			if ticket.Creator == operator {
-				index = int64(i)
-				break
-			}
-		}
-	}
-
-	if !t.checkPermission(operator, index) {
-		return "", fmt.Errorf("%s 只能操作自己点的歌曲", operator)
+	index, err := t.locate(operator, index)
+	if err != nil {
+		return "", err
 	}
 
 	newTicket := &MaimaiTicket{
-		Keyword: t.tickets[index].Keyword,
-		Creator: t.tickets[index].Creator,
-		Record:  t.storage.PickOne(t.tickets[index].Keyword, t.tickets[index].Rank+1),
-		Rank:    t.tickets[index].Rank + 1,
-		Level:   t.tickets[index].Level,
+		Keyword:   t.tickets[index].Keyword,
+		Creator:   t.tickets[index].Creator,
+		CreatorID: t.tickets[index].CreatorID,
+		Level:     t.tickets[index].Level,
+		Price:     t.tickets[index].Price,
+		Pinned:    t.tickets[index].Pinned,
+		CreatedAt: t.tickets[index].CreatedAt,
+		Query:     t.tickets[index].Query,
+		Random:    t.tickets[index].Random,
+	}
+	if newTicket.Random {
+		// 随机点歌本身会跳过歌单中已有与最近演奏过的歌曲
+		err = t.pickRandom(newTicket)
+	} else if err = newTicket.pick(t.storage, t.tickets[index].Rank+1); err == nil {
+		// 换歌总是跳过歌单中已有或冷却中的歌曲, 否则下次换歌还会停在同一首
+		err = t.skipDuplicates(newTicket, t.tickets[index], true)
+	}
+	if err != nil {
+		return "", err
 	}
 	t.tickets[index] = newTicket
-	err := t.saveCheckPoint()
+	err = t.saveCheckPoint()
 	if err != nil {
 		return "", err
 	}
 	return "切换成功", nil
 }
 
-func (t *MaimaiTicketMaster) NextLevel(operator string, index int64) (string, error) {
+func (t *MaimaiTicketMaster) NextLevel(operator *model.Viewer, index int64) (string, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	if index >= int64(len(t.tickets)) {
-		return "", fmt.Errorf("%s 编号错误", operator)
+	index, err := t.locate(operator, index)
+	if err != nil {
+		return "", err
 	}
-	if index == -1 {
-		for i, ticket := range t.tickets {
-			if ticket.Creator == operator {
-				index = int64(i)
-				break
-			}
+	t.tickets[index].RotateLevel()
+	err = t.saveCheckPoint()
+	if err != nil {
+		return "", err
+	}
+	return "切换成功", nil
+}
+
+// requireElevated 歌单管理只允许主播、房管与管理员
+func requireElevated(operator *model.Viewer) error {
+	if !operator.Elevated() {
+		return fmt.Errorf("%s 没有管理歌单的权限", operator.Name)
+	}
+	return nil
+}
+
+func (t *MaimaiTicketMaster) checkIndex(operator *model.Viewer, index int64) error {
+	if index < 0 || index >= int64(len(t.tickets)) {
+		return fmt.Errorf("%s 编号错误", operator.Name)
+	}
+	return nil
+}
+
+// checkPinned 置顶的一首固定在第1位, 不能移走, 其他歌曲也不能移到它前面
+func (t *MaimaiTicketMaster) checkPinned(indexes ...int64) error {
+	if len(t.tickets) == 0 || !t.tickets[0].Pinned {
+		return nil
+	}
+	for _, index := range indexes {
+		if index == 0 {
+			return errors.New("正在演奏的歌曲固定在第1位~")
 		}
 	}
-	if !t.checkPermission(operator, index) {
-		return "", fmt.Errorf("%s 只能操作自己点的歌曲", operator)
+	return nil
+}
+
+// MoveTicket 将第 from 首移动到第 to 位
+func (t *MaimaiTicketMaster) MoveTicket(operator *model.Viewer, from int64, to int64) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := requireElevated(operator); err != nil {
+		return "", err
 	}
-	fmt.Println(t.tickets[index])
-	t.tickets[index].RotateLevel()
-	fmt.Println(t.tickets[index])
-	err := t.saveCheckPoint()
+	if err := t.checkIndex(operator, from); err != nil {
+		return "", err
+	}
+	if err := t.checkIndex(operator, to); err != nil {
+		return "", err
+	}
+	if err := t.checkPinned(from, to); err != nil {
+		return "", err
+	}
+	ticket := t.tickets[from]
+	t.tickets = append(t.tickets[:from], t.tickets[from+1:]...)
+	t.tickets = append(t.tickets[:to], append([]*MaimaiTicket{ticket}, t.tickets[to:]...)...)
+	if err := t.saveCheckPoint(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("已将 %s 移到第%d位", ticket.Record.Title, to+1), nil
+}
+
+// SwapTickets 交换两首的位置
+func (t *MaimaiTicketMaster) SwapTickets(operator *model.Viewer, a int64, b int64) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := requireElevated(operator); err != nil {
+		return "", err
+	}
+	if err := t.checkIndex(operator, a); err != nil {
+		return "", err
+	}
+	if err := t.checkIndex(operator, b); err != nil {
+		return "", err
+	}
+	if err := t.checkPinned(a, b); err != nil {
+		return "", err
+	}
+	t.tickets[a], t.tickets[b] = t.tickets[b], t.tickets[a]
+	if err := t.saveCheckPoint(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("已交换第%d位与第%d位", a+1, b+1), nil
+}
+
+// PinTicket 将正在演奏的一首固定在顶部, 同时只有一首固定
+func (t *MaimaiTicketMaster) PinTicket(operator *model.Viewer, index int64) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := requireElevated(operator); err != nil {
+		return "", err
+	}
+	if err := t.checkIndex(operator, index); err != nil {
+		return "", err
+	}
+	ticket := t.tickets[index]
+	for _, other := range t.tickets {
+		other.Pinned = false
+	}
+	ticket.Pinned = true
+	t.tickets = append(t.tickets[:index], t.tickets[index+1:]...)
+	t.tickets = append([]*MaimaiTicket{ticket}, t.tickets...)
+	if err := t.saveCheckPoint(); err != nil {
+		return "", err
+	}
+	return "正在演奏 " + ticket.Record.Title, nil
+}
+
+// ClearTickets 清空歌单
+func (t *MaimaiTicketMaster) ClearTickets(operator *model.Viewer) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := requireElevated(operator); err != nil {
+		return "", err
+	}
+	cleared := t.tickets
+	t.tickets = make([]*MaimaiTicket, 0, t.maxTicketSize)
+	if err := t.saveCheckPoint(); err != nil {
+		return "", err
+	}
+	t.recordHistory(HistoryStatusCleared, cleared...)
+	return fmt.Sprintf("已清空%d首", len(cleared)), nil
+}
+
+// ClearViewerTickets 清空第 index 首的点歌者点的所有歌曲, 观众可以清空自己的
+func (t *MaimaiTicketMaster) ClearViewerTickets(operator *model.Viewer, index int64) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	index, err := t.locate(operator, index)
 	if err != nil {
 		return "", err
 	}
-	return "切换成功", nil
+	owner := t.tickets[index]
+	remain := make([]*MaimaiTicket, 0, t.maxTicketSize)
+	var cleared []*MaimaiTicket
+	for _, ticket := range t.tickets {
+		if ticket.sameCreator(owner) {
+			cleared = append(cleared, ticket)
+		} else {
+			remain = append(remain, ticket)
+		}
+	}
+	t.tickets = remain
+	if err = t.saveCheckPoint(); err != nil {
+		return "", err
+	}
+	t.recordHistory(HistoryStatusCleared, cleared...)
+	return fmt.Sprintf("已清空 %s 的%d首", owner.Creator, len(cleared)), nil
 }
 
-func NewMaimaiTicketMaster(songDatabasePath string, aliasFilePath string, checkPointPath string,
-	maxTicketSize int) *MaimaiTicketMaster {
+// recordHistory 把关闭的点歌写入历史, 失败时只记录日志
+func (t *MaimaiTicketMaster) recordHistory(status string, tickets ...*MaimaiTicket) {
+	now := t.now()
+	entries := make([]*HistoryEntry, 0, len(tickets))
+	for _, ticket := range tickets {
+		entries = append(entries, ticket.historyEntry(status, now))
+	}
+	if err := t.history.Record(entries...); err != nil {
+		log.Printf("failed to record history %v", err)
+	}
+}
+
+func NewMaimaiTicketMaster(storage *MaimaiStorage, checkPointPath string,
+	maxTicketSize int, policy TicketPolicy, history *History) *MaimaiTicketMaster {
 	t := &MaimaiTicketMaster{
 		lock:           sync.RWMutex{},
 		maxTicketSize:  maxTicketSize,
 		checkPointPath: checkPointPath,
-		storage:        NewMaimaiStorage(songDatabasePath, aliasFilePath),
+		storage:        storage,
+		policy:         policy,
+		history:        history,
+		usages:         map[string]*pickUsage{},
+		pending:        map[string]*pendingPick{},
+		now:            time.Now,
+		intn:           rand.IntN,
 	}
 
+	if err := t.loadUsages(); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to load pick usages: %v", err)
+	}
 	if ok := t.loadCheckPoint(); ok != nil {
 		t.tickets = make([]*MaimaiTicket, 0, maxTicketSize)
 		err := t.saveCheckPoint()
@@ -228,6 +578,15 @@ func (t *MaimaiTicketMaster) loadCheckPoint() error {
 	if err != nil {
 		return err
 	}
+	legacy := 0
+	for _, ticket := range tickets {
+		if ticket.CreatorID == "" {
+			legacy++
+		}
+	}
+	if legacy > 0 {
+		log.Printf("%d tickets in check point have no creator_id, only elevated roles can manage them", legacy)
+	}
 	t.tickets = tickets
 	return nil
 }
@@ -245,39 +604,363 @@ func (t *MaimaiTicketMaster) saveCheckPoint() error {
 	if err != nil {
 		return err
 	}
+	return t.saveUsages()
+}
+
+// usagePath 点歌记录保存在检查点旁, 如 tickets.checkpoint.usage.json
+func (t *MaimaiTicketMaster) usagePath() string {
+	return strings.TrimSuffix(t.checkPointPath, filepath.Ext(t.checkPointPath)) + ".usage.json"
+}
+
+func (t *MaimaiTicketMaster) loadUsages() error {
+	if t.checkPointPath == "" {
+		return nil
+	}
+
+	file, err := os.ReadFile(t.usagePath())
+	if err != nil {
+		return err
+	}
+	usages := map[string]*pickUsage{}
+	if err = json.Unmarshal(file, &usages); err != nil {
+		return err
+	}
+	t.usages = usages
 	return nil
 }
 
-func (t *MaimaiTicketMaster) AddTicket(creator string, keyword string) (string, error) {
+// saveUsages 保存点歌记录, 顺便丢弃已经不影响点歌的记录
+func (t *MaimaiTicketMaster) saveUsages() error {
+	now := t.now()
+	for id, usage := range t.usages {
+		if usage.expired(t.policy.PickCooldown, now) {
+			delete(t.usages, id)
+		}
+	}
+	result, err := json.Marshal(t.usages)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(t.usagePath(), result, 0644)
+}
+
+// Flush 将当前歌单写入检查点, 退出前调用
+func (t *MaimaiTicketMaster) Flush() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.saveCheckPoint()
+}
+
+func (t *MaimaiTicketMaster) AddTicket(creator *model.Viewer, keyword string) (string, error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
+	// 确认付费点歌的候选时按付费点歌插入, 不受歌单与次数限制
+	if pending, ok := t.pending[creator.ID()]; ok && pending.price > 0 {
+		ticket, err := t.confirmPending(creator, keyword, t.now())
+		if err != nil {
+			return "", err
+		}
+		if ticket != nil {
+			return t.insertPaid(creator, ticket)
+		}
+	}
 	if len(t.tickets) >= t.maxTicketSize {
 		return "", errors.New("歌单已满~")
 	}
-	targetLevel := 0
-	if strings.HasSuffix(keyword, "紫") || strings.HasPrefix(keyword, "紫") {
-		keyword = strings.Trim(keyword, "紫")
-		targetLevel = -4
-	} else if strings.HasSuffix(keyword, "红") || strings.HasPrefix(keyword, "红") {
-		keyword = strings.Trim(keyword, "红")
-		targetLevel = -3
-	}
-	t.tickets = append(t.tickets, &MaimaiTicket{
-		Keyword: keyword,
-		Creator: creator,
-		Record:  t.storage.PickOne(keyword, 0),
-		Rank:    0,
-		Level:   targetLevel,
-	})
-	err := t.saveCheckPoint()
+	now := t.now()
+	usage := t.usages[creator.ID()]
+	if err := t.policy.checkQuota(creator, usage, t.countActive(creator), now); err != nil {
+		return "", err
+	}
+	ticket, err := t.resolvePick(creator, keyword, 0, now)
+	if err != nil {
+		return "", err
+	}
+	if err := t.dedup(ticket, nil); err != nil {
+		return "", err
+	}
+	if usage == nil {
+		usage = &pickUsage{}
+		t.usages[creator.ID()] = usage
+	}
+	usage.use(now)
+	t.tickets = append(t.tickets, ticket)
+	err = t.saveCheckPoint()
 	if err != nil {
 		log.Fatalf("failed to save ticket check point %v", err)
 		return "", err
 	}
+	if ticket.Rank > 0 {
+		return "成功！已改为 " + ticket.Record.Title, nil
+	}
 	return "成功！", nil
 }
 
+// confirmPending 观众有待确认的候选且发送的是有效序号时返回对应的歌曲, 否则返回 nil; 候选只能确认一次
+func (t *MaimaiTicketMaster) confirmPending(creator *model.Viewer, keyword string, now time.Time) (*MaimaiTicket, error) {
+	pending, ok := t.pending[creator.ID()]
+	if !ok {
+		return nil, nil
+	}
+	delete(t.pending, creator.ID())
+	choice, err := strconv.Atoi(strings.TrimSpace(keyword))
+	if err != nil || !now.Before(pending.expires) || choice < 1 || choice > len(pending.candidates) {
+		return nil, nil
+	}
+	ticket, err := t.newTicket(creator, pending.keyword)
+	if err != nil {
+		return nil, err
+	}
+	if err = ticket.pick(t.storage, pending.candidates[choice-1].Rank); err != nil {
+		return nil, err
+	}
+	ticket.Price = pending.price
+	return ticket, nil
+}
+
+// resolvePick 观众有待确认的候选且发送的是序号时点对应的歌曲, 否则按关键词匹配;
+// 最佳匹配低于 MinMatchScore 时拒绝, 或记录候选等待观众确认, price 为付费点歌的金额
+func (t *MaimaiTicketMaster) resolvePick(creator *model.Viewer, keyword string, price int64, now time.Time) (*MaimaiTicket, error) {
+	if ticket, err := t.confirmPending(creator, keyword, now); err != nil || ticket != nil {
+		return ticket, err
+	}
+
+	ticket, err := t.newTicket(creator, keyword)
+	if err != nil {
+		return nil, err
+	}
+	if t.policy.MinMatchScore <= 0 {
+		return ticket, nil
+	}
+	candidates := t.storage.Explain(ticket.query(), disambiguationSize)
+	if len(candidates) == 0 || candidates[0].Score >= t.policy.MinMatchScore {
+		return ticket, nil
+	}
+	if t.policy.DisambiguationWindow <= 0 {
+		return nil, fmt.Errorf("没有找到 %s, 换个歌名试试吧", ticket.Keyword)
+	}
+	t.pending[creator.ID()] = &pendingPick{
+		keyword:    keyword,
+		candidates: candidates,
+		expires:    now.Add(t.policy.DisambiguationWindow),
+		price:      price,
+	}
+	var titles []string
+	for i, candidate := range candidates {
+		titles = append(titles, fmt.Sprintf("%d.%s", i+1, candidate.Title))
+	}
+	return nil, fmt.Errorf("没有找到 %s, 是不是 %s? %d秒内发送 点歌 <序号> 确认",
+		ticket.Keyword, strings.Join(titles, " "), int(t.policy.DisambiguationWindow.Seconds()))
+}
+
+// AddRandomTicket 随机点歌, filters 为分类、谱面类型、难度与等级条件, 不会选到歌单中已有或最近演奏过的歌曲
+func (t *MaimaiTicketMaster) AddRandomTicket(creator *model.Viewer, filters string) (string, error) {
+	// 先解析条件, 不是随机点歌的弹幕不受歌单与次数限制影响
+	query, err := ParseRandomQuery(filters, t.storage.Categories())
+	if err != nil {
+		return "", err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(t.tickets) >= t.maxTicketSize {
+		return "", errors.New("歌单已满~")
+	}
+	now := t.now()
+	usage := t.usages[creator.ID()]
+	if err = t.policy.checkQuota(creator, usage, t.countActive(creator), now); err != nil {
+		return "", err
+	}
+	ticket := &MaimaiTicket{
+		Keyword:   strings.TrimSpace(randomKeyword + " " + strings.Join(strings.Fields(filters), " ")),
+		Creator:   creator.Name,
+		CreatorID: creator.ID(),
+		CreatedAt: now,
+		Random:    true,
+	}
+	if query.HasFilter() {
+		ticket.Query = &query
+	}
+	if err = t.pickRandom(ticket); err != nil {
+		return "", err
+	}
+	if usage == nil {
+		usage = &pickUsage{}
+		t.usages[creator.ID()] = usage
+	}
+	usage.use(now)
+	t.tickets = append(t.tickets, ticket)
+	err = t.saveCheckPoint()
+	if err != nil {
+		log.Fatalf("failed to save ticket check point %v", err)
+		return "", err
+	}
+	return "成功！随机到 " + ticket.Record.Title, nil
+}
+
+// pickRandom 按点歌条件重新随机, 排除歌单中已有与最近演奏过的歌曲
+func (t *MaimaiTicketMaster) pickRandom(ticket *MaimaiTicket) error {
+	window := randomReplayWindow
+	if t.policy.ReplayCooldown > window {
+		window = t.policy.ReplayCooldown
+	}
+	now := t.now()
+	query := PickQuery{}
+	if ticket.Query != nil {
+		query = *ticket.Query
+	}
+	record, err := t.storage.RandomPick(query, func(record *MaimaiRecord) bool {
+		for _, existing := range t.tickets {
+			if existing.Record.ID == record.ID {
+				return true
+			}
+		}
+		last := t.history.LastPlayed(record.ID)
+		return !last.IsZero() && now.Sub(last) < window
+	}, t.intn)
+	if err != nil {
+		return err
+	}
+	ticket.Record, ticket.Rank = record, 0
+	ticket.Level = query.ticketLevel(record)
+	return nil
+}
+
+// maxDuplicateRedirect 重复点歌最多顺延的匹配结果数
+const maxDuplicateRedirect = 5
+
+// dedup 歌单中已有或冷却中的歌曲按规则顺延到下一个匹配结果或拒绝, 最多顺延 maxDuplicateRedirect 次;
+// upgrading 为被付费升级或换歌替换的点歌, 不算重复
+func (t *MaimaiTicketMaster) dedup(ticket *MaimaiTicket, upgrading *MaimaiTicket) error {
+	return t.skipDuplicates(ticket, upgrading, t.policy.RedirectDuplicate)
+}
+
+// skipDuplicates redirect 为 true 时遇到重复顺延到下一个匹配结果, 否则直接返回错误
+func (t *MaimaiTicketMaster) skipDuplicates(ticket *MaimaiTicket, upgrading *MaimaiTicket, redirect bool) error {
+	for redirects := 0; ; redirects++ {
+		err := t.checkDuplicate(ticket.Record, upgrading)
+		if err == nil {
+			return nil
+		}
+		if !redirect || redirects >= maxDuplicateRedirect {
+			return err
+		}
+		if err = ticket.pick(t.storage, ticket.Rank+1); err != nil {
+			return err
+		}
+	}
+}
+
+func (t *MaimaiTicketMaster) checkDuplicate(record *MaimaiRecord, upgrading *MaimaiTicket) error {
+	for _, existing := range t.tickets {
+		if existing != upgrading && existing.Record.ID == record.ID {
+			return fmt.Errorf("%s 已经在歌单里了", record.Title)
+		}
+	}
+	if t.policy.ReplayCooldown <= 0 {
+		return nil
+	}
+	last := t.history.LastPlayed(record.ID)
+	if last.IsZero() {
+		return nil
+	}
+	if wait := t.policy.ReplayCooldown - t.now().Sub(last); wait > 0 {
+		return fmt.Errorf("%s 刚刚演奏过, %d分钟后再点吧", record.Title, int(wait.Minutes())+1)
+	}
+	return nil
+}
+
+// countActive 观众当前在歌单中的点歌数
+func (t *MaimaiTicketMaster) countActive(creator *model.Viewer) int {
+	count := 0
+	for _, ticket := range t.tickets {
+		if ticket.owns(creator) {
+			count++
+		}
+	}
+	return count
+}
+
+// AddPaidTicket 付费点歌, 排在所有免费点歌之前、已有付费点歌之后, 不受每人点歌限制;
+// 同一观众已点过相同关键词的免费歌曲会被升级为付费点歌
+func (t *MaimaiTicketMaster) AddPaidTicket(creator *model.Viewer, keyword string, price int64) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.policy.PaidMinBattery <= 0 || price < t.policy.PaidMinBattery {
+		return "", ErrPaidBelowThreshold
+	}
+	keyword = strings.TrimSpace(keyword)
+	if keyword == "" {
+		return "", errors.New("付费点歌需要歌名")
+	}
+
+	// 付费留言内容随意, 同样检查匹配度
+	ticket, err := t.resolvePick(creator, keyword, price, t.now())
+	if err != nil {
+		return "", err
+	}
+	ticket.Price = price
+	return t.insertPaid(creator, ticket)
+}
+
+// insertPaid 付费点歌插在置顶与已有付费点歌之后, 同一观众点过同一首歌时升级原来的点歌
+func (t *MaimaiTicketMaster) insertPaid(creator *model.Viewer, ticket *MaimaiTicket) (string, error) {
+	var upgrading *MaimaiTicket
+	for _, existing := range t.tickets {
+		if existing.Price == 0 && existing.owns(creator) && existing.Keyword == ticket.Keyword {
+			upgrading = existing
+			break
+		}
+	}
+	if upgrading == nil && len(t.tickets) >= t.maxTicketSize && !t.policy.PaidExceedLimit {
+		return "", errors.New("歌单已满~")
+	}
+	if err := t.dedup(ticket, upgrading); err != nil {
+		return "", err
+	}
+	if upgrading != nil {
+		ticket.CreatedAt = upgrading.CreatedAt
+		for i, existing := range t.tickets {
+			if existing == upgrading {
+				t.tickets = append(t.tickets[:i], t.tickets[i+1:]...)
+				break
+			}
+		}
+	}
+
+	position := 0
+	for position < len(t.tickets) && (t.tickets[position].Pinned || t.tickets[position].Price > 0) {
+		position++
+	}
+	t.tickets = append(t.tickets[:position], append([]*MaimaiTicket{ticket}, t.tickets[position:]...)...)
+	err := t.saveCheckPoint()
+	if err != nil {
+		log.Fatalf("failed to save ticket check point %v", err)
+		return "", err
+	}
+	return fmt.Sprintf("付费点歌成功！第%d位", position+1), nil
+}
+
+// newTicket 解析点歌条件并匹配第一个结果
+func (t *MaimaiTicketMaster) newTicket(creator *model.Viewer, keyword string) (*MaimaiTicket, error) {
+	query := ParsePickQuery(keyword)
+	ticket := &MaimaiTicket{
+		Keyword:   query.Keyword,
+		Creator:   creator.Name,
+		CreatorID: creator.ID(),
+		CreatedAt: t.now(),
+	}
+	if query.HasFilter() {
+		ticket.Query = &query
+	}
+	if err := ticket.pick(t.storage, 0); err != nil {
+		return nil, err
+	}
+	return ticket, nil
+}
+
 func (t *MaimaiTicketMaster) ForEachTicket(fn func(ticket model.ITicket)) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
@@ -0,0 +1,425 @@
+package service
+
+import (
+	"math/rand/v2"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"wolfy/model"
+)
+
+func newTestStorage() *MaimaiStorage {
+	s := &MaimaiStorage{
+		records: map[int]*MaimaiRecord{},
+		aliases: map[int][]string{},
+	}
+	for id, title := range map[int]string{
+		1: "系ぎて",
+		2: "PANDORA PARADOXXX",
+		3: "Oshama Scramble!",
+		4: "QZKago Requiem",
+	} {
+		s.records[id] = &MaimaiRecord{
+			ID:    id,
+			Title: title,
+			Levels: []MaimaiLevel{
+				{Type: "dx", Difficulty: "bas", Level: "5.0"},
+				{Type: "dx", Difficulty: "adv", Level: "8.0"},
+				{Type: "dx", Difficulty: "exp", Level: "12.0"},
+				{Type: "dx", Difficulty: "mas", Level: "14.5"},
+			},
+		}
+		s.aliases[id] = []string{title}
+	}
+	s.aliases[1] = append(s.aliases[1], "系统")
+	s.aliases[2] = append(s.aliases[2], "潘")
+	s.sourceAliases = mergeAliases(s.records, s.aliases)
+	s.setAliases(s.aliases)
+	return s
+}
+
+func newTestTicketMaster(maxTicketSize int, policy TicketPolicy) *MaimaiTicketMaster {
+	return &MaimaiTicketMaster{
+		maxTicketSize: maxTicketSize,
+		storage:       newTestStorage(),
+		policy:        policy,
+		history:       NewHistory(""),
+		usages:        map[string]*pickUsage{},
+		pending:       map[string]*pendingPick{},
+		now:           time.Now,
+		intn:          rand.IntN,
+	}
+}
+
+func queue(t *MaimaiTicketMaster) string {
+	var titles []string
+	for _, ticket := range t.tickets {
+		titles = append(titles, ticket.Creator+":"+ticket.Record.Title)
+	}
+	return strings.Join(titles, ",")
+}
+
+func Test_PaidTicketsGoAheadOfFreePicks(t *testing.T) {
+	master := newTestTicketMaster(3, TicketPolicy{PaidMinBattery: 100})
+	for _, c := range []struct{ creator, keyword string }{{"a", "系统"}, {"b", "潘"}} {
+		if _, err := master.AddTicket(&model.Viewer{Name: c.creator}, c.keyword); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := master.AddPaidTicket(&model.Viewer{Name: "c"}, "Oshama Scramble!", 99); err != ErrPaidBelowThreshold {
+		t.Fatalf("expected ErrPaidBelowThreshold, got %v", err)
+	}
+	if _, err := master.AddPaidTicket(&model.Viewer{Name: "c"}, "Oshama Scramble!", 100); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queue(master), "c:Oshama Scramble!,a:系ぎて,b:PANDORA PARADOXXX"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if master.tickets[0].Price != 100 {
+		t.Fatalf("expected price to be recorded, got %d", master.tickets[0].Price)
+	}
+
+	// 已满时不能再付费点歌, 但可以升级自己的免费点歌
+	if _, err := master.AddPaidTicket(&model.Viewer{Name: "d"}, "QZKago Requiem", 1000); err == nil {
+		t.Fatal("expected full queue to reject paid pick")
+	}
+	if _, err := master.AddPaidTicket(&model.Viewer{Name: "b"}, "潘", 500); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queue(master), "c:Oshama Scramble!,b:PANDORA PARADOXXX,a:系ぎて"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	master.policy.PaidExceedLimit = true
+	if _, err := master.AddPaidTicket(&model.Viewer{Name: "d"}, "QZKago Requiem", 1000); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queue(master), "c:Oshama Scramble!,b:PANDORA PARADOXXX,d:QZKago Requiem,a:系ぎて"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func Test_PerViewerPickLimits(t *testing.T) {
+	master := newTestTicketMaster(12, TicketPolicy{
+		MaxActivePerViewer: 1,
+		PickCooldown:       time.Minute,
+		DailyQuota:         2,
+		ExemptGuardLevel:   3,
+	})
+	now := time.Date(2024, 5, 1, 20, 0, 0, 0, time.Local)
+	master.now = func() time.Time { return now }
+	viewer := &model.Viewer{Name: "a"}
+
+	if _, err := master.AddTicket(viewer, "系统"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.AddTicket(viewer, "潘"); err == nil || !strings.Contains(err.Error(), "最多同时点1首") {
+		t.Fatalf("expected active limit, got %v", err)
+	}
+	if _, err := master.FinishTicket(viewer, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.AddTicket(viewer, "潘"); err == nil || !strings.Contains(err.Error(), "冷却") {
+		t.Fatalf("expected cooldown, got %v", err)
+	}
+	now = now.Add(time.Minute)
+	if _, err := master.AddTicket(viewer, "潘"); err != nil {
+		t.Fatal(err)
+	}
+	master.tickets = nil
+	now = now.Add(time.Minute)
+	if _, err := master.AddTicket(viewer, "Oshama"); err == nil || !strings.Contains(err.Error(), "今天") {
+		t.Fatalf("expected daily quota, got %v", err)
+	}
+
+	// 第二天重置次数
+	now = now.Add(24 * time.Hour)
+	if _, err := master.AddTicket(viewer, "Oshama"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 舰长不受限制
+	captain := &model.Viewer{Name: "b", GuardLevel: 3}
+	for _, keyword := range []string{"系统", "潘", "QZKago"} {
+		if _, err := master.AddTicket(captain, keyword); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_PickLimitsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tickets.checkpoint.json")
+	policy := TicketPolicy{PickCooldown: time.Hour, DailyQuota: 1}
+	now := time.Date(2024, 5, 1, 20, 0, 0, 0, time.Local)
+	viewer := &model.Viewer{OpenID: "open-a", Name: "a"}
+
+	master := NewMaimaiTicketMaster(newTestStorage(), path, 12, policy, NewHistory(""))
+	master.now = func() time.Time { return now }
+	if _, err := master.AddTicket(viewer, "系统"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.FinishTicket(viewer, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后冷却与每日次数仍然有效
+	master = NewMaimaiTicketMaster(newTestStorage(), path, 12, policy, NewHistory(""))
+	master.now = func() time.Time { return now }
+	if _, err := master.AddTicket(viewer, "潘"); err == nil || !strings.Contains(err.Error(), "冷却") {
+		t.Fatalf("expected cooldown after restart, got %v", err)
+	}
+	now = now.Add(2 * time.Hour)
+	if _, err := master.AddTicket(viewer, "潘"); err == nil || !strings.Contains(err.Error(), "今天") {
+		t.Fatalf("expected daily quota after restart, got %v", err)
+	}
+}
+
+func Test_TicketsAreOwnedByOpenID(t *testing.T) {
+	master := newTestTicketMaster(12, TicketPolicy{})
+	alice := &model.Viewer{OpenID: "open-a", Name: "同名"}
+	bob := &model.Viewer{OpenID: "open-b", Name: "同名"}
+	if _, err := master.AddTicket(alice, "系统"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同名的其他观众不能删除, 弹幕里自称主播也不行
+	if _, err := master.FinishTicket(bob, 0); err == nil {
+		t.Fatal("expected viewer with the same name to be rejected")
+	}
+	if _, err := master.FinishTicket(&model.Viewer{OpenID: "open-c", Name: "主播"}, 0); err == nil {
+		t.Fatal("expected impersonated anchor to be rejected")
+	}
+
+	// 改名后仍然可以操作, 显示名同步更新
+	renamed := &model.Viewer{OpenID: "open-a", Name: "新名字"}
+	if _, err := master.NextLevel(renamed, -1); err != nil {
+		t.Fatal(err)
+	}
+	if master.tickets[0].Creator != "新名字" {
+		t.Fatalf("expected display name to follow rename, got %s", master.tickets[0].Creator)
+	}
+	if _, err := master.FinishTicket(&model.Viewer{Name: "主播", Role: model.RoleAnchor}, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_LegacyTicketsNeedElevatedRoles(t *testing.T) {
+	master := newTestTicketMaster(12, TicketPolicy{})
+	master.tickets = []*MaimaiTicket{{Keyword: "系统", Creator: "老观众", Record: master.storage.PickOne("系统", 0)}}
+
+	// 没有 CreatorID 的旧点歌不能按昵称认领
+	if _, err := master.NextRank(&model.Viewer{OpenID: "open-old", Name: "老观众"}, 0); err == nil {
+		t.Fatal("expected legacy ticket to reject a viewer with the same name")
+	}
+	if _, err := master.FinishTicket(&model.Viewer{OpenID: "open-old", Name: "老观众"}, -1); err == nil {
+		t.Fatal("expected legacy ticket not to be found by name")
+	}
+	if _, err := master.FinishTicket(&model.Viewer{OpenID: "open-mod", Name: "房管", Role: model.RoleModerator}, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ElevatedRolesManageAnyTicket(t *testing.T) {
+	master := newTestTicketMaster(12, TicketPolicy{})
+	if _, err := master.AddTicket(&model.Viewer{OpenID: "open-a", Name: "a"}, "系统"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.NextRank(&model.Viewer{OpenID: "open-b", Name: "b"}, 0); err == nil {
+		t.Fatal("expected plain viewer to be rejected")
+	}
+	for _, role := range []model.Role{model.RoleModerator, model.RoleAdmin, model.RoleAnchor} {
+		if _, err := master.NextLevel(&model.Viewer{OpenID: "open-" + role.String(), Role: role}, 0); err != nil {
+			t.Fatalf("%s: %v", role, err)
+		}
+	}
+	if _, err := master.FinishTicket(&model.Viewer{OpenID: "open-admin", Role: model.RoleAdmin}, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_QueueManagement(t *testing.T) {
+	master := newTestTicketMaster(12, TicketPolicy{PaidMinBattery: 100})
+	for _, c := range []struct{ creator, keyword string }{{"a", "系统"}, {"b", "潘"}, {"a", "Oshama Scramble!"}} {
+		if _, err := master.AddTicket(&model.Viewer{OpenID: "open-" + c.creator, Name: c.creator}, c.keyword); err != nil {
+			t.Fatal(err)
+		}
+	}
+	viewer := &model.Viewer{OpenID: "open-b", Name: "b"}
+	moderator := &model.Viewer{OpenID: "open-m", Name: "m", Role: model.RoleModerator}
+
+	if _, err := master.MoveTicket(viewer, 1, 0); err == nil {
+		t.Fatal("expected plain viewer to be rejected")
+	}
+	if _, err := master.MoveTicket(moderator, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queue(master), "a:Oshama Scramble!,a:系ぎて,b:PANDORA PARADOXXX"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if _, err := master.SwapTickets(moderator, 0, 3); err == nil {
+		t.Fatal("expected out of range index to be rejected")
+	}
+	if _, err := master.SwapTickets(moderator, 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queue(master), "b:PANDORA PARADOXXX,a:系ぎて,a:Oshama Scramble!"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	// 正在演奏的一首固定在顶部, 付费点歌排在其后
+	if _, err := master.PinTicket(moderator, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.AddPaidTicket(&model.Viewer{OpenID: "open-c", Name: "c"}, "QZKago Requiem", 100); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queue(master), "a:系ぎて,c:QZKago Requiem,b:PANDORA PARADOXXX,a:Oshama Scramble!"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	// 置顶的一首不能移走, 其他歌曲也不能移到它前面
+	if _, err := master.MoveTicket(moderator, 0, 2); err == nil {
+		t.Fatal("expected pinned ticket not to be moved")
+	}
+	if _, err := master.MoveTicket(moderator, 3, 0); err == nil {
+		t.Fatal("expected ticket not to be moved above the pinned one")
+	}
+	if _, err := master.SwapTickets(moderator, 2, 0); err == nil {
+		t.Fatal("expected pinned ticket not to be swapped")
+	}
+	if _, err := master.SwapTickets(moderator, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queue(master), "a:系ぎて,a:Oshama Scramble!,b:PANDORA PARADOXXX,c:QZKago Requiem"; got != want || !master.tickets[0].Pinned {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if _, err := master.SwapTickets(moderator, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// 观众只能清空自己的点歌
+	if _, err := master.ClearViewerTickets(viewer, 0); err == nil {
+		t.Fatal("expected viewer to be rejected clearing others")
+	}
+	if _, err := master.ClearViewerTickets(&model.Viewer{OpenID: "open-a", Name: "a"}, -1); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queue(master), "c:QZKago Requiem,b:PANDORA PARADOXXX"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if _, err := master.ClearTickets(viewer); err == nil {
+		t.Fatal("expected plain viewer to be rejected")
+	}
+	if _, err := master.ClearTickets(moderator); err != nil {
+		t.Fatal(err)
+	}
+	if len(master.tickets) != 0 {
+		t.Fatalf("expected empty queue, got %s", queue(master))
+	}
+}
+
+func Test_DuplicateAndRecentlyPlayedSongs(t *testing.T) {
+	master := newTestTicketMaster(12, TicketPolicy{ReplayCooldown: 30 * time.Minute})
+	now := time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)
+	master.now = func() time.Time { return now }
+	anchor := &model.Viewer{OpenID: "open-anchor", Name: "主播", Role: model.RoleAnchor}
+	if _, err := master.AddTicket(&model.Viewer{OpenID: "open-a", Name: "a"}, "系统"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.AddTicket(&model.Viewer{OpenID: "open-b", Name: "b"}, "系统"); err == nil || !strings.Contains(err.Error(), "已经在歌单里") {
+		t.Fatalf("expected duplicate to be rejected, got %v", err)
+	}
+	if _, err := master.FinishTicket(anchor, 0); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(10 * time.Minute)
+	if _, err := master.AddTicket(&model.Viewer{OpenID: "open-b", Name: "b"}, "系统"); err == nil || !strings.Contains(err.Error(), "21分钟") {
+		t.Fatalf("expected replay cooldown, got %v", err)
+	}
+	now = now.Add(30 * time.Minute)
+	if _, err := master.AddTicket(&model.Viewer{OpenID: "open-b", Name: "b"}, "系统"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 顺延到下一个匹配结果
+	master.policy.RedirectDuplicate = true
+	msg, err := master.AddTicket(&model.Viewer{OpenID: "open-c", Name: "c"}, "系统")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if master.tickets[1].Record.ID == master.tickets[0].Record.ID || master.tickets[1].Rank != 1 {
+		t.Fatalf("expected redirect to the next match, got %s (%s)", queue(master), msg)
+	}
+
+	// 换歌跳过歌单中已有的歌曲, 与 RedirectDuplicate 无关, 连续换歌不会停在同一首
+	master.policy.RedirectDuplicate = false
+	seen := map[int]bool{master.tickets[1].Record.ID: true}
+	for i := 0; i < 3; i++ {
+		if _, err = master.NextRank(anchor, 1); err != nil {
+			t.Fatal(err)
+		}
+		if id := master.tickets[1].Record.ID; id == master.tickets[0].Record.ID {
+			t.Fatalf("expected re-pick to skip the queued song, got %s", queue(master))
+		} else {
+			seen[id] = true
+		}
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected re-pick to cycle through the other songs, got %v", seen)
+	}
+}
+
+func Test_LowConfidencePicks(t *testing.T) {
+	master := newTestTicketMaster(12, TicketPolicy{MinMatchScore: 90})
+	now := time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)
+	master.now = func() time.Time { return now }
+	a := &model.Viewer{OpenID: "open-a", Name: "a"}
+	if _, err := master.AddTicket(a, "完全不相关"); err == nil || !strings.Contains(err.Error(), "没有找到") {
+		t.Fatalf("expected low confidence pick to be rejected, got %v", err)
+	}
+	if _, err := master.AddTicket(a, "oshama"); err != nil {
+		t.Fatal(err)
+	}
+
+	master.policy.DisambiguationWindow = time.Minute
+	_, err := master.AddTicket(a, "紫PANDORA PARADOX QZ")
+	if err == nil || !strings.Contains(err.Error(), "1.PANDORA PARADOXXX") {
+		t.Fatalf("expected candidates, got %v", err)
+	}
+	if _, err := master.AddTicket(a, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if ticket := master.tickets[1]; ticket.Record.ID != 2 || ticket.Record.GetTrackDifficulty(ticket.Level) != "mas" {
+		t.Fatalf("expected confirmed pick to keep level, got %+v", ticket)
+	}
+
+	// 超时后序号按普通关键词处理
+	if _, err := master.AddTicket(a, "xyz"); err == nil {
+		t.Fatal("expected candidates")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := master.AddTicket(a, "1"); err == nil || !strings.Contains(err.Error(), "没有找到 1") {
+		t.Fatalf("expected expired choice to be matched as keyword, got %v", err)
+	}
+	if len(master.tickets) != 2 {
+		t.Fatalf("unexpected queue %s", queue(master))
+	}
+
+	// 付费留言同样检查匹配度, 确认候选后按付费点歌插入
+	master.policy.PaidMinBattery = 1000
+	b := &model.Viewer{OpenID: "open-b", Name: "b"}
+	if _, err = master.AddPaidTicket(b, "主播加油", 3000); err == nil || !strings.Contains(err.Error(), "是不是") {
+		t.Fatalf("expected paid pick to ask for confirmation, got %v", err)
+	}
+	if len(master.tickets) != 2 {
+		t.Fatalf("expected low confidence paid pick not to be queued, got %s", queue(master))
+	}
+	if _, err = master.AddTicket(b, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if ticket := master.tickets[0]; ticket.Price != 3000 || ticket.Creator != "b" {
+		t.Fatalf("expected confirmed paid pick at the front, got %s", queue(master))
+	}
+}
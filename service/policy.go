@@ -0,0 +1,106 @@
+package service
+
+import (
+	"fmt"
+	"time"
+	"wolfy/model"
+)
+
+// TicketPolicy 歌单规则, 由启动参数配置
+type TicketPolicy struct {
+	// PaidMinBattery 单次礼物或付费留言达到该电池数时优先点歌, 0 表示关闭付费点歌
+	PaidMinBattery int64
+	// PaidExceedLimit 付费点歌是否可以超出歌单上限
+	PaidExceedLimit bool
+
+	// MaxActivePerViewer 每位观众同时在歌单中的点歌数, 0 表示不限制
+	MaxActivePerViewer int
+	// PickCooldown 同一观众两次点歌的最小间隔, 0 表示不限制
+	PickCooldown time.Duration
+	// DailyQuota 每位观众每天的点歌次数, 0 表示不限制
+	DailyQuota int
+	// ExemptGuardLevel 大航海等级不低于该等级的观众不受限制 (1总督 2提督 3舰长), 0 表示不豁免
+	ExemptGuardLevel int
+	// ExemptFansMedalLevel 粉丝牌达到该等级的观众不受限制, 0 表示不豁免
+	ExemptFansMedalLevel int
+	// ExemptAdmin 房管不受限制
+	ExemptAdmin bool
+
+	// RedirectDuplicate 点到歌单中已有或冷却中的歌曲时改为下一个匹配结果, 否则直接拒绝
+	RedirectDuplicate bool
+	// ReplayCooldown 演奏过的歌曲在该时间内不能再点, 0 表示不限制
+	ReplayCooldown time.Duration
+
+	// MinMatchScore 最佳匹配的得分低于该值时不直接点歌, 0 表示不限制;
+	// 别名完全一致为 200, 前缀为 150 以上, 模糊匹配不超过 100, 读音匹配打九折
+	MinMatchScore int
+	// DisambiguationWindow 低于 MinMatchScore 时列出候选, 观众在该时间内发送 点歌 <序号> 确认, 0 表示直接拒绝
+	DisambiguationWindow time.Duration
+
+	// AllowUtage 宴会场歌曲是否可以点
+	AllowUtage bool
+	// AllowLocked 需要活动解锁的歌曲是否可以点, 只有游戏数据中有解锁信息
+	AllowLocked bool
+}
+
+// exempt 观众是否不受点歌频率与次数限制
+func (p *TicketPolicy) exempt(viewer *model.Viewer) bool {
+	if viewer.Role == model.RoleAnchor {
+		return true
+	}
+	if p.ExemptAdmin && viewer.IsAdmin {
+		return true
+	}
+	if p.ExemptGuardLevel > 0 && viewer.GuardLevel > 0 && viewer.GuardLevel <= p.ExemptGuardLevel {
+		return true
+	}
+	if p.ExemptFansMedalLevel > 0 && viewer.FansMedalLevel >= p.ExemptFansMedalLevel {
+		return true
+	}
+	return false
+}
+
+// pickUsage 观众的点歌记录, 与歌单检查点一起保存, 重启后冷却与每日次数不会清零
+type pickUsage struct {
+	Last  time.Time `json:"last"`
+	Day   string    `json:"day"`
+	Count int       `json:"count"`
+}
+
+// checkQuota 检查观众是否可以再点一首, active 为其当前在歌单中的点歌数
+func (p *TicketPolicy) checkQuota(viewer *model.Viewer, usage *pickUsage, active int, now time.Time) error {
+	if p.exempt(viewer) {
+		return nil
+	}
+	if p.MaxActivePerViewer > 0 && active >= p.MaxActivePerViewer {
+		return fmt.Errorf("最多同时点%d首", p.MaxActivePerViewer)
+	}
+	if usage == nil {
+		return nil
+	}
+	if p.PickCooldown > 0 {
+		if wait := usage.Last.Add(p.PickCooldown).Sub(now); wait > 0 {
+			return fmt.Errorf("点歌冷却中, %d秒后再试", int(wait.Seconds())+1)
+		}
+	}
+	if p.DailyQuota > 0 && usage.Day == now.Format(time.DateOnly) && usage.Count >= p.DailyQuota {
+		return fmt.Errorf("今天已经点了%d首啦", usage.Count)
+	}
+	return nil
+}
+
+// use 记录一次点歌
+func (u *pickUsage) use(now time.Time) {
+	day := now.Format(time.DateOnly)
+	if u.Day != day {
+		u.Day = day
+		u.Count = 0
+	}
+	u.Last = now
+	u.Count++
+}
+
+// expired 冷却已过且不是今天的记录, 不再影响点歌
+func (u *pickUsage) expired(cooldown time.Duration, now time.Time) bool {
+	return u.Day != now.Format(time.DateOnly) && !u.Last.Add(cooldown).After(now)
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+	"wolfy/model"
+)
+
+const (
+	ProposalPending  = "pending"
+	ProposalApproved = "approved"
+	ProposalRejected = "rejected"
+
+	// maxAliasLength 别名的最大字数
+	maxAliasLength = 32
+	// maxPendingPerProposer 每位观众同时待审核的申请数
+	maxPendingPerProposer = 3
+)
+
+var ErrProposalNotFound = errors.New("没有这条别名申请")
+
+// AliasProposal 观众通过弹幕提交的别名
+type AliasProposal struct {
+	ID         int64     `json:"id"`
+	SongID     int       `json:"song_id"`
+	Title      string    `json:"title"`
+	Alias      string    `json:"alias"`
+	Proposer   string    `json:"proposer"`
+	ProposerID string    `json:"proposer_id"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	Reviewer   string    `json:"reviewer,omitempty"`
+	ReviewedAt time.Time `json:"reviewed_at,omitempty"`
+}
+
+// AliasModerator 别名申请队列, 审核通过的别名写入本地覆盖文件, 不会被在线别名刷新覆盖
+type AliasModerator struct {
+	lock          sync.Mutex
+	storage       *MaimaiStorage
+	proposalsPath string
+	overlayPath   string
+	proposals     []*AliasProposal
+	overlay       *Aliases
+	nextID        int64
+	now           func() time.Time
+}
+
+// NewAliasModerator 读取申请队列与覆盖文件, 并把覆盖的别名合并到曲库, path 为空时只保存在内存中
+func NewAliasModerator(storage *MaimaiStorage, proposalsPath string, overlayPath string) *AliasModerator {
+	m := &AliasModerator{
+		storage:       storage,
+		proposalsPath: proposalsPath,
+		overlayPath:   overlayPath,
+		proposals:     make([]*AliasProposal, 0),
+		overlay:       &Aliases{},
+		now:           time.Now,
+	}
+	if err := readJSON(proposalsPath, &m.proposals); err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+	if err := readJSON(overlayPath, m.overlay); err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+	for _, proposal := range m.proposals {
+		if proposal.ID >= m.nextID {
+			m.nextID = proposal.ID + 1
+		}
+	}
+	m.storage.SetOverlay(m.overlay)
+	return m
+}
+
+func readJSON(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+func writeJSON(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+// Propose 提交别名, target 为歌曲id或标题; 主播与房管提交的直接通过
+func (m *AliasModerator) Propose(proposer *model.Viewer, target string, alias string) (string, error) {
+	alias = strings.TrimSpace(alias)
+	if alias == "" || utf8.RuneCountInString(alias) > maxAliasLength {
+		return "", fmt.Errorf("别名需要1到%d个字", maxAliasLength)
+	}
+	record, ok := m.storage.FindSong(target)
+	if !ok {
+		return "", fmt.Errorf("找不到歌曲 %s", target)
+	}
+	if m.storage.HasAlias(record.ID, alias) {
+		return "", fmt.Errorf("%s 已经是 %s 的别名了", alias, record.Title)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	songID := songKey(record.ID)
+	pending := 0
+	for _, proposal := range m.proposals {
+		if proposal.Status != ProposalPending {
+			continue
+		}
+		if proposal.SongID == songID && strings.EqualFold(proposal.Alias, alias) {
+			return "", fmt.Errorf("%s 已经在审核中了", alias)
+		}
+		if proposal.ProposerID == proposer.ID() {
+			pending++
+		}
+	}
+	if !proposer.Elevated() && pending >= maxPendingPerProposer {
+		return "", fmt.Errorf("最多同时提交%d条别名, 请等待审核", maxPendingPerProposer)
+	}
+	proposal := &AliasProposal{
+		ID:         m.nextID,
+		SongID:     songID,
+		Title:      record.Title,
+		Alias:      alias,
+		Proposer:   proposer.Name,
+		ProposerID: proposer.ID(),
+		Status:     ProposalPending,
+		CreatedAt:  m.now(),
+	}
+	m.nextID++
+	m.proposals = append(m.proposals, proposal)
+	if proposer.Elevated() {
+		if err := m.review(proposal, proposer.Name, true); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("已添加别名 %s → %s", alias, record.Title), nil
+	}
+	if err := writeJSON(m.proposalsPath, m.proposals); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("别名 %s → %s 已提交审核", alias, record.Title), nil
+}
+
+// Proposals 按状态筛选申请, status 为空时返回全部
+func (m *AliasModerator) Proposals(status string) []AliasProposal {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	result := make([]AliasProposal, 0)
+	for _, proposal := range m.proposals {
+		if status == "" || proposal.Status == status {
+			result = append(result, *proposal)
+		}
+	}
+	return result
+}
+
+// Review 通过或拒绝一条待审核的申请
+func (m *AliasModerator) Review(id int64, reviewer string, approve bool) (*AliasProposal, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, proposal := range m.proposals {
+		if proposal.ID != id {
+			continue
+		}
+		if proposal.Status != ProposalPending {
+			return nil, fmt.Errorf("别名申请已经处理过了")
+		}
+		if err := m.review(proposal, reviewer, approve); err != nil {
+			return nil, err
+		}
+		result := *proposal
+		return &result, nil
+	}
+	return nil, ErrProposalNotFound
+}
+
+func (m *AliasModerator) review(proposal *AliasProposal, reviewer string, approve bool) error {
+	proposal.Reviewer = reviewer
+	proposal.ReviewedAt = m.now()
+	proposal.Status = ProposalRejected
+	if approve {
+		proposal.Status = ProposalApproved
+		m.addOverlay(proposal.SongID, proposal.Alias)
+		if err := writeJSON(m.overlayPath, m.overlay); err != nil {
+			return err
+		}
+		m.storage.SetOverlay(m.overlay)
+	}
+	return writeJSON(m.proposalsPath, m.proposals)
+}
+
+func (m *AliasModerator) addOverlay(songID int, alias string) {
+	for i := range m.overlay.Alias {
+		if m.overlay.Alias[i].SongID == songID {
+			m.overlay.Alias[i].Aliases = append(m.overlay.Alias[i].Aliases, alias)
+			return
+		}
+	}
+	m.overlay.Alias = append(m.overlay.Alias, Alias{SongID: songID, Aliases: []string{alias}})
+}
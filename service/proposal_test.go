@@ -0,0 +1,122 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"wolfy/model"
+)
+
+func Test_AliasProposalsAreModerated(t *testing.T) {
+	dir := t.TempDir()
+	storage := newTestStorage()
+	storage.records[2].ID = 10002
+	moderator := NewAliasModerator(storage, filepath.Join(dir, "proposals.json"), filepath.Join(dir, "overlay.json"))
+	viewer := &model.Viewer{OpenID: "open-a", Name: "a"}
+
+	if _, err := moderator.Propose(viewer, "不存在的歌", "别名"); err == nil {
+		t.Fatal("expected unknown song to be rejected")
+	}
+	if _, err := moderator.Propose(viewer, "2", "潘"); err == nil {
+		t.Fatal("expected existing alias to be rejected")
+	}
+	if _, err := moderator.Propose(viewer, "10002", "潘多拉"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := moderator.Propose(&model.Viewer{OpenID: "open-b", Name: "b"}, "PANDORA PARADOXXX", "潘多拉"); err == nil {
+		t.Fatal("expected duplicate pending proposal to be rejected")
+	}
+	pending := moderator.Proposals(ProposalPending)
+	if len(pending) != 1 || pending[0].SongID != 2 || pending[0].ProposerID != "open-a" {
+		t.Fatalf("unexpected proposals %+v", pending)
+	}
+	if storage.HasAlias(2, "潘多拉") {
+		t.Fatal("expected pending alias not to be used")
+	}
+
+	if _, err := moderator.Review(pending[0].ID, "主播", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := moderator.Review(pending[0].ID, "主播", false); err == nil {
+		t.Fatal("expected reviewed proposal to be rejected")
+	}
+	if _, err := moderator.Review(99, "主播", true); err != ErrProposalNotFound {
+		t.Fatalf("expected ErrProposalNotFound, got %v", err)
+	}
+	if storage.PickOne("潘多拉", 0).Title != "PANDORA PARADOXXX" {
+		t.Fatal("expected approved alias to be used")
+	}
+
+	// 房管提交的直接通过
+	if _, err := moderator.Propose(&model.Viewer{OpenID: "open-m", Role: model.RoleModerator}, "系统", "系"); err != nil {
+		t.Fatal(err)
+	}
+	if !storage.HasAlias(1, "系") {
+		t.Fatal("expected moderator alias to be approved")
+	}
+
+	// 每位观众同时待审核的申请有上限
+	for i := 0; i < maxPendingPerProposer; i++ {
+		if _, err := moderator.Propose(viewer, "3", fmt.Sprintf("欧夏马%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := moderator.Propose(viewer, "4", "QZ"); err == nil || !strings.Contains(err.Error(), "等待审核") {
+		t.Fatalf("expected pending proposals to be capped, got %v", err)
+	}
+
+	// 在线别名刷新与重启后仍然保留
+	storage.lock.Lock()
+	storage.remote = &Aliases{}
+	storage.lock.Unlock()
+	storage.SetOverlay(&Aliases{})
+	NewAliasModerator(storage, filepath.Join(dir, "proposals.json"), filepath.Join(dir, "overlay.json"))
+	if !storage.HasAlias(2, "潘多拉") || !storage.HasAlias(1, "系") {
+		t.Fatal("expected overlay to be reloaded")
+	}
+}
+
+func Test_ReviewDoesNotShareOverlayWithStorage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"aliases": [{"song_id": 1, "aliases": ["系统"]}]}`))
+	}))
+	defer server.Close()
+	defer func(url string) { aliasListURL = url }(aliasListURL)
+	aliasListURL = server.URL
+
+	dir := t.TempDir()
+	storage := newTestStorage()
+	moderator := NewAliasModerator(storage, filepath.Join(dir, "proposals.json"), filepath.Join(dir, "overlay.json"))
+
+	// 审核与后台刷新别名同时进行, go test -race 下不能有数据竞争
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = storage.RefreshAliases()
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		viewer := &model.Viewer{OpenID: fmt.Sprintf("open-%d", i), Name: "a"}
+		if _, err := moderator.Propose(viewer, "2", fmt.Sprintf("别名%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		pending := moderator.Proposals(ProposalPending)
+		if _, err := moderator.Review(pending[0].ID, "主播", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	<-done
+	if !storage.HasAlias(2, "别名19") || !storage.HasAlias(1, "系统") {
+		t.Fatal("expected approved and refreshed aliases")
+	}
+}
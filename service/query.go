@@ -0,0 +1,272 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// PickQuery 点歌指令解析出的关键词与谱面条件, 如 "潘 紫 dx >=14.0"
+type PickQuery struct {
+	Keyword string `json:"keyword"`
+	// Difficulty bas/adv/exp/mas/remas, 为空表示不限
+	Difficulty string `json:"difficulty,omitempty"`
+	// Type dx/std/宴, 为空表示不限
+	Type string `json:"type,omitempty"`
+	// MinLevel MaxLevel 定数范围 (包含), 没有定数时按等级估算, 0 表示不限
+	MinLevel float64 `json:"min_level,omitempty"`
+	MaxLevel float64 `json:"max_level,omitempty"`
+	// Category 歌曲分类, 只用于随机点歌
+	Category string `json:"category,omitempty"`
+}
+
+var difficultyWords = map[string]string{
+	"绿": "bas", "bas": "bas", "basic": "bas",
+	"黄": "adv", "adv": "adv", "advanced": "adv",
+	"红": "exp", "exp": "exp", "expert": "exp",
+	"紫": "mas", "mas": "mas", "master": "mas",
+	"白": "remas", "remas": "remas", "remaster": "remas", "re:mas": "remas", "re:master": "remas",
+}
+
+var chartTypeWords = map[string]string{
+	"dx": "dx", "std": "std", "sd": "std", "标准": "std", "宴": "宴", "utage": "宴",
+}
+
+// legacyDifficultyAffixes 旧的点歌写法, 歌名前后直接接颜色, 如 "紫潘"
+var legacyDifficultyAffixes = []string{"紫", "红"}
+
+// ParsePickQuery 解析点歌内容, 以空白分隔的难度、谱面类型与等级条件可以出现在任意位置, 其余部分为关键词;
+// 只有条件没有关键词时整句作为关键词
+func ParsePickQuery(input string) PickQuery {
+	input = strings.TrimSpace(input)
+	query := PickQuery{}
+	var keyword []string
+	for _, token := range strings.Fields(input) {
+		lower := strings.ToLower(token)
+		if difficulty, ok := difficultyWords[lower]; ok && query.Difficulty == "" {
+			query.Difficulty = difficulty
+		} else if chartType, ok := chartTypeWords[lower]; ok && query.Type == "" {
+			query.Type = chartType
+		} else if !query.parseLevel(lower, false) {
+			keyword = append(keyword, token)
+		}
+	}
+	if len(keyword) == 0 {
+		return PickQuery{Keyword: input}
+	}
+	query.Keyword = strings.Join(keyword, " ")
+	if query.Difficulty == "" {
+		for _, affix := range legacyDifficultyAffixes {
+			if strings.HasPrefix(query.Keyword, affix) || strings.HasSuffix(query.Keyword, affix) {
+				if trimmed := strings.Trim(query.Keyword, affix); trimmed != "" {
+					query.Keyword = trimmed
+					query.Difficulty = difficultyWords[affix]
+				}
+				break
+			}
+		}
+	}
+	return query
+}
+
+// parseLevel 解析 13+, lv13, >=14.0, <13 等等级条件; bare 为 false 时不带 + 与小数点的纯数字视为歌名
+func (q *PickQuery) parseLevel(token string, bare bool) bool {
+	op := ""
+	for _, prefix := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(token, prefix) {
+			op = prefix
+			token = token[len(prefix):]
+			break
+		}
+	}
+	explicit := op != ""
+	for _, prefix := range []string{"lv.", "lv"} {
+		if strings.HasPrefix(token, prefix) {
+			token = token[len(prefix):]
+			explicit = true
+			break
+		}
+	}
+	if !explicit && !bare && !strings.ContainsAny(token, "+.") {
+		return false
+	}
+	low, high, ok := levelRange(token)
+	if !ok {
+		return false
+	}
+	switch op {
+	case ">=":
+		q.MinLevel = low
+	case ">":
+		q.MinLevel = high + 0.1
+	case "<=":
+		q.MaxLevel = high
+	case "<":
+		q.MaxLevel = low - 0.1
+	default:
+		q.MinLevel, q.MaxLevel = low, high
+	}
+	return true
+}
+
+// ErrUnknownFilter 随机点歌的条件中有不认识的词, 这时弹幕多半只是聊天
+var ErrUnknownFilter = errors.New("不认识的条件")
+
+// ParseRandomQuery 解析随机点歌的条件, 每个词都必须是难度、谱面类型、等级或 categories 中的分类, 纯数字视为等级
+func ParseRandomQuery(input string, categories []string) (PickQuery, error) {
+	query := PickQuery{}
+	for _, token := range strings.Fields(input) {
+		lower := strings.ToLower(token)
+		if difficulty, ok := difficultyWords[lower]; ok && query.Difficulty == "" {
+			query.Difficulty = difficulty
+		} else if chartType, ok := chartTypeWords[lower]; ok && query.Type == "" {
+			query.Type = chartType
+		} else if query.parseLevel(lower, true) {
+			continue
+		} else if category := matchCategory(categories, token); category != "" && query.Category == "" {
+			query.Category = category
+		} else if lower != "all" && token != "全部" {
+			return PickQuery{}, fmt.Errorf("%w %s", ErrUnknownFilter, token)
+		}
+	}
+	return query, nil
+}
+
+// matchCategory 分类名包含该词时返回分类, 如 东方 对应 东方Project
+func matchCategory(categories []string, token string) string {
+	norm := normalizeKeyword(token)
+	if len([]rune(norm)) < 2 {
+		return ""
+	}
+	for _, category := range categories {
+		if strings.Contains(normalizeKeyword(category), norm) {
+			return category
+		}
+	}
+	return ""
+}
+
+// levelRange 等级对应的定数范围, 13 为 13.0~13.6, 13+ 为 13.7~13.9, 14.0 只包含 14.0
+func levelRange(level string) (float64, float64, bool) {
+	if strings.HasSuffix(level, "+") {
+		base, err := strconv.Atoi(strings.TrimSuffix(level, "+"))
+		if err != nil || base <= 0 {
+			return 0, 0, false
+		}
+		return float64(base) + 0.7, float64(base) + 0.9, true
+	}
+	if strings.Contains(level, ".") {
+		value, err := strconv.ParseFloat(level, 64)
+		if err != nil || value <= 0 {
+			return 0, 0, false
+		}
+		return value, value, true
+	}
+	base, err := strconv.Atoi(level)
+	if err != nil || base <= 0 {
+		return 0, 0, false
+	}
+	if base >= 7 {
+		return float64(base), float64(base) + 0.6, true
+	}
+	// 7 以下没有 + 等级
+	return float64(base), float64(base) + 0.9, true
+}
+
+// levelValue 谱面定数, 没有定数时取等级的下限
+func levelValue(level MaimaiLevel) float64 {
+	if level.Constant > 0 {
+		return level.Constant
+	}
+	low, _, _ := levelRange(level.Level)
+	return low
+}
+
+// tenths 定数按 0.1 比较, 避免浮点误差
+func tenths(value float64) int {
+	return int(math.Round(value * 10))
+}
+
+// HasFilter 是否有谱面或分类条件
+func (q PickQuery) HasFilter() bool {
+	return q.Difficulty != "" || q.Type != "" || q.MinLevel > 0 || q.MaxLevel > 0 || q.Category != ""
+}
+
+func (q PickQuery) matchLevel(level MaimaiLevel) bool {
+	if q.Difficulty != "" && level.Difficulty != q.Difficulty {
+		return false
+	}
+	if q.Type != "" && level.Type != q.Type {
+		return false
+	}
+	if q.MinLevel > 0 || q.MaxLevel > 0 {
+		value := tenths(levelValue(level))
+		if value == 0 {
+			return false
+		}
+		if q.MinLevel > 0 && value < tenths(q.MinLevel) {
+			return false
+		}
+		if q.MaxLevel > 0 && value > tenths(q.MaxLevel) {
+			return false
+		}
+	}
+	return true
+}
+
+// chartIndex 满足条件的最难谱面在 Levels 中的下标, 没有时返回 -1
+func (q PickQuery) chartIndex(record *MaimaiRecord) int {
+	for i := len(record.Levels) - 1; i >= 0; i-- {
+		if q.matchLevel(record.Levels[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Match 歌曲是否有满足条件的谱面
+func (q PickQuery) Match(record *MaimaiRecord) bool {
+	if q.Category != "" && record.Category != q.Category {
+		return false
+	}
+	return !q.HasFilter() || q.chartIndex(record) >= 0
+}
+
+// ticketLevel 满足条件的谱面对应的 MaimaiTicket.Level, 没有条件时为 0 即最难的谱面
+func (q PickQuery) ticketLevel(record *MaimaiRecord) int {
+	index := q.chartIndex(record)
+	if index < 0 {
+		return 0
+	}
+	return len(record.Levels) - 1 - index
+}
+
+// String 条件的简短描述, 用于提示
+func (q PickQuery) String() string {
+	var parts []string
+	if q.Keyword != "" {
+		parts = append(parts, q.Keyword)
+	}
+	if q.Category != "" {
+		parts = append(parts, q.Category)
+	}
+	if q.Type != "" {
+		parts = append(parts, q.Type)
+	}
+	if q.Difficulty != "" {
+		parts = append(parts, q.Difficulty)
+	}
+	switch {
+	case q.MinLevel > 0 && q.MaxLevel > 0 && tenths(q.MinLevel) == tenths(q.MaxLevel):
+		parts = append(parts, fmt.Sprintf("%.1f", q.MinLevel))
+	case q.MinLevel > 0 && q.MaxLevel > 0:
+		parts = append(parts, fmt.Sprintf("%.1f~%.1f", q.MinLevel, q.MaxLevel))
+	case q.MinLevel > 0:
+		parts = append(parts, fmt.Sprintf(">=%.1f", q.MinLevel))
+	case q.MaxLevel > 0:
+		parts = append(parts, fmt.Sprintf("<=%.1f", q.MaxLevel))
+	}
+	return strings.Join(parts, " ")
+}
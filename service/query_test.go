@@ -0,0 +1,133 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"wolfy/model"
+)
+
+func Test_ParsePickQuery(t *testing.T) {
+	for input, want := range map[string]PickQuery{
+		"潘":                 {Keyword: "潘"},
+		"紫潘":                {Keyword: "潘", Difficulty: "mas"},
+		"潘红":                {Keyword: "潘", Difficulty: "exp"},
+		"潘 白":               {Keyword: "潘", Difficulty: "remas"},
+		"Oshama Scramble 紫": {Keyword: "Oshama Scramble", Difficulty: "mas"},
+		"潘 DX mas 14+":      {Keyword: "潘", Type: "dx", Difficulty: "mas", MinLevel: 14.7, MaxLevel: 14.9},
+		"std lv13 系统":       {Keyword: "系统", Type: "std", MinLevel: 13, MaxLevel: 13.6},
+		"系统 >=14.0":         {Keyword: "系统", MinLevel: 14},
+		"系统 <13+":           {Keyword: "系统", MaxLevel: 13.6},
+		"系统 >13":            {Keyword: "系统", MinLevel: 13.7},
+		"39":                {Keyword: "39"},
+		"紫":                 {Keyword: "紫"},
+		"宴 13+":             {Keyword: "宴 13+"},
+	} {
+		if got := ParsePickQuery(input); got != want {
+			t.Fatalf("ParsePickQuery(%q) = %+v, want %+v", input, got, want)
+		}
+	}
+}
+
+func Test_PickWithChartFilters(t *testing.T) {
+	master := newTestTicketMaster(12, TicketPolicy{})
+	master.storage.records[5] = &MaimaiRecord{
+		ID:    5,
+		Title: "PANDORA BOXXX",
+		Levels: []MaimaiLevel{
+			{Type: "std", Difficulty: "bas", Level: "4"},
+			{Type: "std", Difficulty: "adv", Level: "7+"},
+			{Type: "std", Difficulty: "exp", Level: "11", Constant: 11.4},
+			{Type: "std", Difficulty: "mas", Level: "13+", Constant: 13.8},
+		},
+	}
+	master.storage.aliases[5] = []string{"PANDORA BOXXX"}
+	master.storage.setAliases(mergeAliases(master.storage.records, master.storage.aliases))
+	a := &model.Viewer{OpenID: "open-a", Name: "a"}
+
+	if _, err := master.AddTicket(a, "pandora std"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.AddTicket(a, "pandora 12.0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.AddTicket(a, "oshama dx 绿"); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []struct {
+		id         int
+		difficulty string
+	}{{5, "mas"}, {2, "exp"}, {3, "bas"}} {
+		ticket := master.tickets[i]
+		if ticket.Record.ID != want.id || ticket.Record.GetTrackDifficulty(ticket.Level) != want.difficulty {
+			t.Fatalf("ticket %d: got %d %s, want %d %s", i, ticket.Record.ID, ticket.Record.GetTrackDifficulty(ticket.Level), want.id, want.difficulty)
+		}
+	}
+	if _, err := master.AddTicket(a, "pandora >=15"); err == nil {
+		t.Fatal("expected no chart to match")
+	}
+
+	// 换歌只在满足条件的歌曲中轮换, 并重新选中谱面
+	if _, err := master.NextRank(a, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ticket := master.tickets[0]; ticket.Record.ID != 5 {
+		t.Fatalf("expected the only std song to be picked again, got %d", ticket.Record.ID)
+	}
+	if _, err := master.NextRank(a, 1); err != nil {
+		t.Fatal(err)
+	}
+	if ticket := master.tickets[1]; ticket.Record.ID == 2 || ticket.Record.ID == 5 || ticket.Record.GetTrackDifficulty(ticket.Level) != "exp" {
+		t.Fatalf("expected 12.0 chart of the next song, got %d %s", ticket.Record.ID, ticket.Record.GetTrackDifficulty(ticket.Level))
+	}
+}
+
+func Test_RandomPick(t *testing.T) {
+	master := newTestTicketMaster(12, TicketPolicy{})
+	now := time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)
+	master.now = func() time.Time { return now }
+	master.intn = func(n int) int { return 0 }
+	master.storage.records[3].Category = "东方Project"
+	master.storage.records[3].Levels[3] = MaimaiLevel{Type: "dx", Difficulty: "mas", Level: "13+", Constant: 13.7}
+	a := &model.Viewer{OpenID: "open-a", Name: "a"}
+	anchor := &model.Viewer{OpenID: "open-anchor", Name: "主播", Role: model.RoleAnchor}
+
+	if _, err := master.AddRandomTicket(a, "东方 紫 13+"); err != nil {
+		t.Fatal(err)
+	}
+	if ticket := master.tickets[0]; ticket.Record.ID != 3 || ticket.Keyword != "随机 东方 紫 13+" {
+		t.Fatalf("unexpected random ticket %+v", ticket)
+	}
+	if _, err := master.AddRandomTicket(a, "东方"); err == nil {
+		t.Fatal("expected queued song to be excluded")
+	}
+	if _, err := master.AddRandomTicket(a, "东方 火星"); !errors.Is(err, ErrUnknownFilter) {
+		t.Fatal("expected unknown filter to be rejected")
+	}
+
+	// 演奏过的歌曲在一段时间内不会再随机到
+	if _, err := master.FinishTicket(anchor, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := master.AddRandomTicket(a, "东方"); err == nil {
+		t.Fatal("expected recently played song to be excluded")
+	}
+	now = now.Add(randomReplayWindow)
+	if _, err := master.AddRandomTicket(a, "东方"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 换歌重新随机, 不会换回同一首
+	if _, err := master.AddRandomTicket(a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if master.tickets[1].Record.ID != 1 {
+		t.Fatalf("expected the lowest remaining id, got %d", master.tickets[1].Record.ID)
+	}
+	if _, err := master.NextRank(a, 1); err != nil {
+		t.Fatal(err)
+	}
+	if ticket := master.tickets[1]; ticket.Record.ID != 2 || !ticket.Random {
+		t.Fatalf("expected re-roll to skip the current song, got %+v", ticket)
+	}
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"github.com/mozillazg/go-pinyin"
+	"strings"
+	"unicode"
+)
+
+var pinyinArgs = pinyin.NewArgs()
+
+// kanaRomaji 平假名的罗马音 (平文式), 片假名在 normalizeKeyword 中已转为平假名
+var kanaRomaji = map[rune]string{
+	'あ': "a", 'い': "i", 'う': "u", 'え': "e", 'お': "o",
+	'か': "ka", 'き': "ki", 'く': "ku", 'け': "ke", 'こ': "ko",
+	'さ': "sa", 'し': "shi", 'す': "su", 'せ': "se", 'そ': "so",
+	'た': "ta", 'ち': "chi", 'つ': "tsu", 'て': "te", 'と': "to",
+	'な': "na", 'に': "ni", 'ぬ': "nu", 'ね': "ne", 'の': "no",
+	'は': "ha", 'ひ': "hi", 'ふ': "fu", 'へ': "he", 'ほ': "ho",
+	'ま': "ma", 'み': "mi", 'む': "mu", 'め': "me", 'も': "mo",
+	'や': "ya", 'ゆ': "yu", 'よ': "yo",
+	'ら': "ra", 'り': "ri", 'る': "ru", 'れ': "re", 'ろ': "ro",
+	'わ': "wa", 'ゐ': "i", 'ゑ': "e", 'を': "o", 'ん': "n",
+	'が': "ga", 'ぎ': "gi", 'ぐ': "gu", 'げ': "ge", 'ご': "go",
+	'ざ': "za", 'じ': "ji", 'ず': "zu", 'ぜ': "ze", 'ぞ': "zo",
+	'だ': "da", 'ぢ': "ji", 'づ': "zu", 'で': "de", 'ど': "do",
+	'ば': "ba", 'び': "bi", 'ぶ': "bu", 'べ': "be", 'ぼ': "bo",
+	'ぱ': "pa", 'ぴ': "pi", 'ぷ': "pu", 'ぺ': "pe", 'ぽ': "po",
+	'ゔ': "vu",
+	'ぁ': "a", 'ぃ': "i", 'ぅ': "u", 'ぇ': "e", 'ぉ': "o",
+	'ゃ': "ya", 'ゅ': "yu", 'ょ': "yo", 'ゎ': "wa",
+}
+
+// smallKana 与前一个假名组成拗音
+var smallKana = map[rune]bool{
+	'ぁ': true, 'ぃ': true, 'ぅ': true, 'ぇ': true, 'ぉ': true,
+	'ゃ': true, 'ゅ': true, 'ょ': true,
+}
+
+func isKana(r rune) bool {
+	return r >= 'ぁ' && r <= 'ゖ' || r == 'ー'
+}
+
+// romajiAt 从 runes[i] 开始的一个音节的罗马音, 返回消耗的字数
+func romajiAt(runes []rune, i int) (string, int) {
+	r := runes[i]
+	if r == 'っ' {
+		if i+1 < len(runes) {
+			next, n := romajiAt(runes, i+1)
+			if next != "" && !strings.ContainsAny(next[:1], "aiueon") {
+				return next[:1] + next, n + 1
+			}
+		}
+		return "", 1
+	}
+	if r == 'ー' {
+		// 长音不写出
+		return "", 1
+	}
+	base, ok := kanaRomaji[r]
+	if !ok {
+		return string(r), 1
+	}
+	if i+1 < len(runes) && smallKana[runes[i+1]] && len(base) > 1 {
+		small := kanaRomaji[runes[i+1]]
+		consonant := base[:len(base)-1]
+		if small[0] == 'y' && (base == "shi" || base == "chi" || base == "ji") {
+			// しゃ → sha, じょ → jo
+			small = small[1:]
+		}
+		return consonant + small, 2
+	}
+	return base, 1
+}
+
+// readingForms 汉字的全拼与首字母、假名的罗马音, 其余字符保留; 不含汉字与假名时返回空
+func readingForms(norm string) (full string, initials string) {
+	runes := []rune(norm)
+	var fullBuilder, initialsBuilder strings.Builder
+	hasHan, hasKana := false, false
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.Is(unicode.Han, r):
+			if py := pinyin.SinglePinyin(r, pinyinArgs); len(py) > 0 {
+				hasHan = true
+				fullBuilder.WriteString(py[0])
+				initialsBuilder.WriteString(py[0][:1])
+				i++
+				continue
+			}
+		case isKana(r):
+			hasKana = true
+			romaji, n := romajiAt(runes, i)
+			fullBuilder.WriteString(romaji)
+			if romaji != "" {
+				initialsBuilder.WriteString(romaji[:1])
+			}
+			i += n
+			continue
+		}
+		fullBuilder.WriteRune(r)
+		initialsBuilder.WriteRune(r)
+		i++
+	}
+	if !hasHan && !hasKana {
+		return "", ""
+	}
+	if !hasHan {
+		// 罗马音的首字母没人这么打
+		return fullBuilder.String(), ""
+	}
+	return fullBuilder.String(), initialsBuilder.String()
+}
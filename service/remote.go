@@ -0,0 +1,366 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	LxnsSongListURL        = "https://maimai.lxns.net/api/v0/maimai/song/list?notes=true"
+	DivingFishMusicDataURL = "https://www.diving-fish.com/api/maimaidxprober/music_data"
+	// DefaultSongCacheDir 在线曲库的缓存目录
+	DefaultSongCacheDir = "./runtime"
+)
+
+var difficultyNames = []string{"bas", "adv", "exp", "mas", "remas"}
+
+// RemoteSongSource 从 lxns 或水鱼查分器的公开接口导入曲库, 缓存到本地, 离线时使用缓存
+type RemoteSongSource struct {
+	Format    string
+	URL       string
+	CachePath string
+	// MaxAge 缓存在该时间内不重新请求, 0 表示每次都请求 (带 ETag)
+	MaxAge time.Duration
+	Client *http.Client
+}
+
+// songCacheMeta 与缓存文件放在一起, 记录 ETag 与获取时间
+type songCacheMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"last_modified"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+func NewRemoteSongSource(format string, url string) *RemoteSongSource {
+	if url == "" {
+		url = LxnsSongListURL
+		if format == SongSourceDivingFish {
+			url = DivingFishMusicDataURL
+		}
+	}
+	return &RemoteSongSource{
+		Format:    format,
+		URL:       url,
+		CachePath: filepath.Join(DefaultSongCacheDir, "songs."+format+".json"),
+		Client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (r *RemoteSongSource) Name() string {
+	return r.Format + ":" + r.URL
+}
+
+func (r *RemoteSongSource) Load() (map[int]*MaimaiRecord, map[int][]string, error) {
+	body, err := r.fetch()
+	if err != nil {
+		return nil, nil, err
+	}
+	switch r.Format {
+	case SongSourceLxns:
+		return parseLxnsSongs(body)
+	case SongSourceDivingFish:
+		return parseDivingFishSongs(body)
+	}
+	return nil, nil, fmt.Errorf("unknown song source format %q", r.Format)
+}
+
+func (r *RemoteSongSource) metaPath() string {
+	return r.CachePath + ".meta"
+}
+
+func (r *RemoteSongSource) readCache() ([]byte, *songCacheMeta) {
+	body, err := os.ReadFile(r.CachePath)
+	if err != nil {
+		return nil, nil
+	}
+	meta := &songCacheMeta{}
+	if content, err := os.ReadFile(r.metaPath()); err == nil {
+		_ = json.Unmarshal(content, meta)
+	}
+	if meta.URL != r.URL {
+		// 换了接口地址, ETag 不再有效
+		meta = &songCacheMeta{}
+	}
+	return body, meta
+}
+
+func (r *RemoteSongSource) writeCache(body []byte, meta *songCacheMeta) error {
+	if err := os.MkdirAll(filepath.Dir(r.CachePath), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(r.CachePath, body, 0644); err != nil {
+		return err
+	}
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.metaPath(), content, 0644)
+}
+
+// fetch 返回接口内容, 未修改或请求失败时返回缓存
+func (r *RemoteSongSource) fetch() ([]byte, error) {
+	cached, meta := r.readCache()
+	if cached != nil && r.MaxAge > 0 && time.Since(meta.FetchedAt) < r.MaxAge {
+		return cached, nil
+	}
+
+	body, fresh, err := r.request(meta)
+	if err != nil {
+		if cached == nil {
+			return nil, err
+		}
+		log.Printf("failed to fetch songs from %s, using cache from %v: %v", r.URL, meta.FetchedAt, err)
+		return cached, nil
+	}
+	if body == nil {
+		// 304, 缓存仍然有效
+		meta.FetchedAt = time.Now()
+		body = cached
+	} else {
+		meta = fresh
+	}
+	if err = r.writeCache(body, meta); err != nil {
+		log.Printf("failed to write song cache %s: %v", r.CachePath, err)
+	}
+	return body, nil
+}
+
+// request 带 If-None-Match 请求接口, 返回 nil body 表示未修改
+func (r *RemoteSongSource) request(meta *songCacheMeta) ([]byte, *songCacheMeta, error) {
+	req, err := http.NewRequest(http.MethodGet, r.URL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta != nil && meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta != nil && meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified && meta != nil {
+		return nil, nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !json.Valid(body) {
+		return nil, nil, fmt.Errorf("invalid json from %s", r.URL)
+	}
+	return body, &songCacheMeta{
+		URL:          r.URL,
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		FetchedAt:    time.Now(),
+	}, nil
+}
+
+type lxnsSongList struct {
+	Songs    []lxnsSong    `json:"songs"`
+	Versions []lxnsVersion `json:"versions"`
+}
+
+type lxnsVersion struct {
+	Title   string `json:"title"`
+	Version int    `json:"version"`
+}
+
+type lxnsSong struct {
+	ID           int    `json:"id"`
+	Title        string `json:"title"`
+	Artist       string `json:"artist"`
+	Genre        string `json:"genre"`
+	BPM          int    `json:"bpm"`
+	Version      int    `json:"version"`
+	Disabled     bool   `json:"disabled"`
+	Difficulties struct {
+		Standard []lxnsDifficulty `json:"standard"`
+		DX       []lxnsDifficulty `json:"dx"`
+		Utage    []lxnsDifficulty `json:"utage"`
+	} `json:"difficulties"`
+}
+
+type lxnsDifficulty struct {
+	Difficulty   int     `json:"difficulty"`
+	Level        string  `json:"level"`
+	LevelValue   float64 `json:"level_value"`
+	NoteDesigner string  `json:"note_designer"`
+	Notes        *struct {
+		Total int `json:"total"`
+	} `json:"notes"`
+}
+
+// lxnsVersionTitle 版本号对应的版本名, 版本号不低于该版本的起始版本号
+func lxnsVersionTitle(versions []lxnsVersion, version int) string {
+	title := ""
+	for _, v := range versions {
+		if v.Version <= version {
+			title = v.Title
+		}
+	}
+	return title
+}
+
+func parseLxnsSongs(body []byte) (map[int]*MaimaiRecord, map[int][]string, error) {
+	var list lxnsSongList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(list.Versions, func(i, j int) bool {
+		return list.Versions[i].Version < list.Versions[j].Version
+	})
+
+	records := map[int]*MaimaiRecord{}
+	aliases := map[int][]string{}
+	for _, song := range list.Songs {
+		if song.Disabled {
+			continue
+		}
+		// 标准、dx 与宴会场谱面分组并入同一首歌, 宴会场的id本身带有 100000 偏移
+		for _, set := range []struct {
+			noteType string
+			charts   []lxnsDifficulty
+		}{
+			{"std", song.Difficulties.Standard},
+			{"dx", song.Difficulties.DX},
+			{"宴", song.Difficulties.Utage},
+		} {
+			var levels []MaimaiLevel
+			for _, chart := range set.charts {
+				difficulty := ""
+				if chart.Difficulty >= 0 && chart.Difficulty < len(difficultyNames) {
+					difficulty = difficultyNames[chart.Difficulty]
+				}
+				level := MaimaiLevel{
+					Type:       set.noteType,
+					Difficulty: difficulty,
+					Level:      chart.Level,
+					Constant:   chart.LevelValue,
+					Charter:    designerName(chart.NoteDesigner),
+				}
+				if chart.Notes != nil {
+					level.Notes = chart.Notes.Total
+				}
+				levels = append(levels, level)
+			}
+			if len(levels) == 0 {
+				continue
+			}
+			addRecord(records, aliases, &MaimaiRecord{
+				ID:        song.ID,
+				Title:     song.Title,
+				ImagePath: coverPath(normalizeSongID(song.ID)),
+				Levels:    levels,
+				Category:  song.Genre,
+				Artist:    song.Artist,
+				BPM:       song.BPM,
+				Version:   lxnsVersionTitle(list.Versions, song.Version),
+			})
+		}
+	}
+	return records, aliases, nil
+}
+
+type divingFishMusic struct {
+	ID     string    `json:"id"`
+	Title  string    `json:"title"`
+	Type   string    `json:"type"`
+	DS     []float64 `json:"ds"`
+	Level  []string  `json:"level"`
+	Charts []struct {
+		Notes   []int  `json:"notes"`
+		Charter string `json:"charter"`
+	} `json:"charts"`
+	BasicInfo struct {
+		Artist string `json:"artist"`
+		Genre  string `json:"genre"`
+		BPM    int    `json:"bpm"`
+		From   string `json:"from"`
+	} `json:"basic_info"`
+}
+
+func parseDivingFishSongs(body []byte) (map[int]*MaimaiRecord, map[int][]string, error) {
+	var musics []divingFishMusic
+	if err := json.Unmarshal(body, &musics); err != nil {
+		return nil, nil, err
+	}
+	// 按id排序, 使结果与接口返回的顺序无关
+	sort.Slice(musics, func(i, j int) bool {
+		a, _ := strconv.Atoi(musics[i].ID)
+		b, _ := strconv.Atoi(musics[j].ID)
+		return a < b
+	})
+
+	records := map[int]*MaimaiRecord{}
+	aliases := map[int][]string{}
+	for _, music := range musics {
+		rawID, err := strconv.Atoi(music.ID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid song id %q: %v", music.ID, err)
+		}
+		noteType := "std"
+		if rawID >= 100000 {
+			noteType = "宴"
+		} else if music.Type == "DX" {
+			noteType = "dx"
+		}
+		var levels []MaimaiLevel
+		for i, level := range music.Level {
+			if i >= len(difficultyNames) {
+				break
+			}
+			l := MaimaiLevel{
+				Type:       noteType,
+				Difficulty: difficultyNames[i],
+				Level:      level,
+			}
+			if i < len(music.DS) {
+				l.Constant = music.DS[i]
+			}
+			if i < len(music.Charts) {
+				l.Charter = designerName(music.Charts[i].Charter)
+				for _, notes := range music.Charts[i].Notes {
+					l.Notes += notes
+				}
+			}
+			levels = append(levels, l)
+		}
+		if len(levels) == 0 {
+			continue
+		}
+		addRecord(records, aliases, &MaimaiRecord{
+			ID:        rawID,
+			Title:     music.Title,
+			ImagePath: coverPath(normalizeSongID(rawID)),
+			Levels:    levels,
+			Category:  music.BasicInfo.Genre,
+			Artist:    music.BasicInfo.Artist,
+			BPM:       music.BasicInfo.BPM,
+			Version:   music.BasicInfo.From,
+		})
+	}
+	return records, aliases, nil
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// newSongListServer 按 ETag 返回 fixture, If-None-Match 命中时返回 304
+func newSongListServer(t *testing.T, fixture string) (*httptest.Server, *atomic.Int32) {
+	body, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var full atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full.Add(1)
+		_, _ = w.Write(body)
+	}))
+	return server, &full
+}
+
+func Test_LxnsSongSourceCachesAndFallsBack(t *testing.T) {
+	server, full := newSongListServer(t, "lxns_song_list.json")
+	source := NewRemoteSongSource(SongSourceLxns, server.URL)
+	source.CachePath = filepath.Join(t.TempDir(), "songs.lxns.json")
+
+	records, aliases, err := source.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[100834] == nil || !records[100834].IsUtage() {
+		t.Fatalf("expected disabled song to be skipped and utage kept separately, got %d records", len(records))
+	}
+	record := records[834]
+	if record.ID != 834 || record.Artist != "削除" || record.BPM != 150 || record.Version != "maimai MURASAKi" {
+		t.Fatalf("unexpected record %+v", record)
+	}
+	if got := record.Levels[len(record.Levels)-1]; got.Type != "dx" || got.Difficulty != "remas" || got.Constant != 15.0 {
+		t.Fatalf("expected dx charts ordered by difficulty, got %+v", record.Levels)
+	}
+	if len(record.Levels) != 5 || record.Levels[0].Type != "std" || record.Levels[1].Difficulty != "mas" {
+		t.Fatalf("expected std and dx charts merged, got %+v", record.Levels)
+	}
+	if got := record.Levels[3]; got.Charter != "サファ太 vs -ZONE- SaFaRi" || got.Notes != 1228 {
+		t.Fatalf("unexpected master chart %+v", got)
+	}
+	if record.GetTrackDifficulty(0) != "remas" || records[8].GetTrackType(0) != "std" {
+		t.Fatalf("unexpected chart rotation %+v", record.Levels)
+	}
+	if aliases[8][0] != "True Love Song" {
+		t.Fatalf("unexpected aliases %v", aliases[8])
+	}
+
+	// 第二次请求命中 ETag, 使用缓存
+	if _, _, err = source.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if full.Load() != 1 {
+		t.Fatalf("expected one full download, got %d", full.Load())
+	}
+
+	// 离线时使用缓存
+	server.Close()
+	records, _, err = source.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected cached records, got %d", len(records))
+	}
+}
+
+func Test_DivingFishSongSource(t *testing.T) {
+	server, _ := newSongListServer(t, "diving_fish_music_data.json")
+	defer server.Close()
+	source := NewRemoteSongSource(SongSourceDivingFish, server.URL)
+	source.CachePath = filepath.Join(t.TempDir(), "songs.diving-fish.json")
+
+	records, _, err := source.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := records[834]
+	if record == nil || record.ID != 10834 || record.GetTrackType(0) != "dx" || record.Version != "maimai FiNALE" {
+		t.Fatalf("expected dx info to win, got %+v", record)
+	}
+	if len(record.Levels) != 9 || record.Levels[3].Type != "std" || record.Levels[3].Constant != 14.9 {
+		t.Fatalf("expected std and dx charts merged, got %+v", record.Levels)
+	}
+	if got := record.Levels[7]; got.Level != "14+" || got.Constant != 14.8 || got.Charter != "サファ太 vs -ZONE- SaFaRi" || got.Notes != 1228 {
+		t.Fatalf("unexpected master chart %+v", got)
+	}
+}
+
+func Test_RemoteSongSourceWithoutCacheFails(t *testing.T) {
+	server, _ := newSongListServer(t, "lxns_song_list.json")
+	server.Close()
+	source := NewRemoteSongSource(SongSourceLxns, server.URL)
+	source.CachePath = filepath.Join(t.TempDir(), "songs.lxns.json")
+	if _, _, err := source.Load(); err == nil {
+		t.Fatal("expected error without network and cache")
+	}
+}
@@ -0,0 +1,319 @@
+package service
+
+import (
+	"container/heap"
+	fuzz "github.com/paul-mannino/go-fuzzywuzzy"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// scoreExact 别名完全一致, scorePrefix 关键词是别名的前缀, 模糊匹配的分数不超过 100
+	scoreExact  = 200
+	scorePrefix = 150
+)
+
+const (
+	entryAlias = iota
+	// entryReading 拼音或罗马音, 得分打九折, 保证别名完全一致时优先
+	entryReading
+	// entryInitials 拼音首字母, 只参与完全一致与前缀匹配
+	entryInitials
+)
+
+const (
+	MatchExact  = "exact"
+	MatchPrefix = "prefix"
+	MatchFuzzy  = "fuzzy"
+	// MatchNone 没有匹配, 按id补足的歌曲
+	MatchNone = "none"
+)
+
+type item struct {
+	score int
+	id    int
+	// entry 得分最高的别名在 entries 中的下标, 没有匹配时为 -1
+	entry int
+	match string
+}
+
+// normalizeKeyword 转小写、全角转半角、片假名转平假名, 并去掉空白与标点
+func normalizeKeyword(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '　':
+			continue
+		case r >= '！' && r <= '～':
+			r -= 0xFEE0
+		case r >= 'ァ' && r <= 'ヶ':
+			r -= 0x60
+		}
+		if unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	if b.Len() == 0 {
+		// 全是符号的别名保留原样
+		return strings.ToLower(strings.TrimSpace(s))
+	}
+	return b.String()
+}
+
+// grams 单字关键词使用单字, 其余使用相邻两字
+func grams(runes []rune) []string {
+	if len(runes) == 1 {
+		return []string{string(runes)}
+	}
+	result := make([]string, 0, len(runes)-1)
+	for i := 0; i+1 < len(runes); i++ {
+		result = append(result, string(runes[i:i+2]))
+	}
+	return result
+}
+
+type searchEntry struct {
+	id   int
+	norm string
+	kind int
+	// alias 原始别名, 读音来自哪个别名
+	alias string
+}
+
+func (e searchEntry) weigh(score int) int {
+	if e.kind == entryAlias {
+		return score
+	}
+	return score * 9 / 10
+}
+
+// SearchIndex 别名及其拼音、罗马音的搜索索引, 建立后只读, 别名变化时整体替换
+type SearchIndex struct {
+	ids     []int
+	entries []searchEntry
+	// byNorm 按 norm 排序的 entries 下标, 用于完全一致与前缀查找
+	byNorm []int
+	// grams 单字与两字片段到 entries 下标的倒排表
+	grams map[string][]int
+}
+
+func NewSearchIndex(aliases map[int][]string) *SearchIndex {
+	x := &SearchIndex{
+		ids:   make([]int, 0, len(aliases)),
+		grams: map[string][]int{},
+	}
+	for id := range aliases {
+		x.ids = append(x.ids, id)
+	}
+	sort.Ints(x.ids)
+	for _, id := range x.ids {
+		seen := map[string]bool{}
+		add := func(norm string, kind int, alias string) {
+			if norm == "" || seen[norm] {
+				return
+			}
+			seen[norm] = true
+			x.entries = append(x.entries, searchEntry{id: id, norm: norm, kind: kind, alias: alias})
+		}
+		for _, alias := range aliases[id] {
+			add(normalizeKeyword(alias), entryAlias, alias)
+		}
+		// 读音放在别名之后, 与别名相同时只保留别名
+		for _, alias := range aliases[id] {
+			full, initials := readingForms(normalizeKeyword(alias))
+			add(full, entryReading, alias)
+			add(initials, entryInitials, alias)
+		}
+	}
+
+	x.byNorm = make([]int, len(x.entries))
+	for i, entry := range x.entries {
+		x.byNorm[i] = i
+		runes := []rune(entry.norm)
+		added := map[string]bool{}
+		// 单字片段用于一两个字的关键词
+		for _, gram := range append(grams(runes), strings.Split(entry.norm, "")...) {
+			if !added[gram] {
+				added[gram] = true
+				x.grams[gram] = append(x.grams[gram], i)
+			}
+		}
+	}
+	sort.Slice(x.byNorm, func(i, j int) bool {
+		return x.entries[x.byNorm[i]].norm < x.entries[x.byNorm[j]].norm
+	})
+	return x
+}
+
+// Len 歌曲数
+func (x *SearchIndex) Len() int {
+	return len(x.ids)
+}
+
+// Search 返回得分最高的 k 首, 同分按id升序; 没有匹配的歌曲按id升序补足, 因此结果包含 min(k, Len()) 首.
+// filter 不为空时只在满足条件的歌曲中查找, 结果可能少于 k 首
+func (x *SearchIndex) Search(keyword string, k int, filter func(id int) bool) []*item {
+	if k > len(x.ids) {
+		k = len(x.ids)
+	}
+	norm := normalizeKeyword(keyword)
+	scores := map[int]*item{}
+	if norm != "" {
+		x.matchPrefix(norm, scores, filter)
+		if len(scores) < k {
+			x.matchFuzzy(norm, scores, filter)
+		}
+	}
+
+	top := &topK{k: k}
+	for _, i := range scores {
+		top.offer(i)
+	}
+	result := top.sorted()
+	for _, id := range x.ids {
+		if len(result) >= k {
+			break
+		}
+		if _, ok := scores[id]; !ok && (filter == nil || filter(id)) {
+			result = append(result, &item{id: id, score: 0, entry: -1, match: MatchNone})
+		}
+	}
+	return result
+}
+
+func (x *SearchIndex) setScore(scores map[int]*item, filter func(id int) bool, entry int, score int, match string) {
+	id := x.entries[entry].id
+	if filter != nil && !filter(id) {
+		return
+	}
+	if old, ok := scores[id]; !ok || score > old.score {
+		scores[id] = &item{id: id, score: score, entry: entry, match: match}
+	}
+}
+
+// matchPrefix 完全一致与前缀命中, 在排序的别名上二分查找
+func (x *SearchIndex) matchPrefix(norm string, scores map[int]*item, filter func(id int) bool) {
+	start := sort.Search(len(x.byNorm), func(i int) bool {
+		return x.entries[x.byNorm[i]].norm >= norm
+	})
+	keywordLen := len([]rune(norm))
+	for i := start; i < len(x.byNorm); i++ {
+		entry := x.entries[x.byNorm[i]]
+		if !strings.HasPrefix(entry.norm, norm) {
+			break
+		}
+		if entry.norm == norm {
+			x.setScore(scores, filter, x.byNorm[i], entry.weigh(scoreExact), MatchExact)
+			continue
+		}
+		// 越接近完整别名分数越高
+		x.setScore(scores, filter, x.byNorm[i], entry.weigh(scorePrefix+(scoreExact-scorePrefix-1)*keywordLen/len([]rune(entry.norm))), MatchPrefix)
+	}
+}
+
+// matchFuzzy 对至少有一个片段相同的别名计算编辑距离相似度, 都没有时退化为全量比较
+func (x *SearchIndex) matchFuzzy(norm string, scores map[int]*item, filter func(id int) bool) {
+	runes := []rune(norm)
+	keywordGrams := grams(runes)
+	if len(runes) == 2 {
+		keywordGrams = append(keywordGrams, strings.Split(norm, "")...)
+	}
+	candidates := map[int]bool{}
+	for _, gram := range keywordGrams {
+		for _, i := range x.grams[gram] {
+			candidates[i] = true
+		}
+	}
+	if len(candidates) == 0 {
+		for i := range x.entries {
+			candidates[i] = true
+		}
+	}
+	for i := range candidates {
+		entry := x.entries[i]
+		if entry.kind == entryInitials {
+			continue
+		}
+		if score := entry.weigh(fuzz.Ratio(entry.norm, norm)); score > 0 {
+			x.setScore(scores, filter, i, score, MatchFuzzy)
+		}
+	}
+}
+
+// topK 保留得分最高的 k 个的小顶堆
+type topK struct {
+	k     int
+	items []*item
+}
+
+// less 排名靠后的在前
+func (t *topK) less(a, b *item) bool {
+	if a.score == b.score {
+		return a.id > b.id
+	}
+	return a.score < b.score
+}
+
+func (t *topK) Len() int           { return len(t.items) }
+func (t *topK) Less(i, j int) bool { return t.less(t.items[i], t.items[j]) }
+func (t *topK) Swap(i, j int)      { t.items[i], t.items[j] = t.items[j], t.items[i] }
+func (t *topK) Push(x interface{}) { t.items = append(t.items, x.(*item)) }
+func (t *topK) Pop() interface{} {
+	last := t.items[len(t.items)-1]
+	t.items = t.items[:len(t.items)-1]
+	return last
+}
+
+func (t *topK) offer(i *item) {
+	if t.k <= 0 {
+		return
+	}
+	if len(t.items) < t.k {
+		heap.Push(t, i)
+		return
+	}
+	if t.less(t.items[0], i) {
+		t.items[0] = i
+		heap.Fix(t, 0)
+	}
+}
+
+// sorted 按排名返回
+func (t *topK) sorted() []*item {
+	result := make([]*item, len(t.items))
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(t).(*item)
+	}
+	return result
+}
+
+// SearchCandidate 搜索结果及命中原因
+type SearchCandidate struct {
+	// Rank 从 0 开始, 与换歌的次数一致
+	Rank  int    `json:"rank"`
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+	Score int    `json:"score"`
+	// Match exact/prefix/fuzzy/none
+	Match string `json:"match"`
+	// Alias 命中的别名, Form 为 alias/reading/initials, Text 为实际比较的文本
+	Alias string `json:"alias,omitempty"`
+	Form  string `json:"form,omitempty"`
+	Text  string `json:"text,omitempty"`
+}
+
+var entryForms = []string{"alias", "reading", "initials"}
+
+// explain 补充命中的别名
+func (x *SearchIndex) explain(i *item) SearchCandidate {
+	candidate := SearchCandidate{ID: i.id, Score: i.score, Match: i.match}
+	if i.entry >= 0 {
+		entry := x.entries[i.entry]
+		candidate.Alias = entry.alias
+		candidate.Form = entryForms[entry.kind]
+		candidate.Text = entry.norm
+	}
+	return candidate
+}
@@ -0,0 +1,214 @@
+package service
+
+import (
+	fuzz "github.com/paul-mannino/go-fuzzywuzzy"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// legacyRankRecord 索引之前的实现, 对每个别名计算 UQRatio 后全量排序, 用于对比
+func legacyRankRecord(aliases map[int][]string, keyword string) []*item {
+	var result = make([]*item, 0, len(aliases))
+	for id, aliases := range aliases {
+		highScore := -1
+		for _, alias := range aliases {
+			score := fuzz.UQRatio(alias, keyword)
+			if strings.ToLower(alias) == strings.ToLower(keyword) {
+				score++
+			}
+			if score > highScore {
+				highScore = score
+			}
+		}
+		result = append(result, &item{
+			id:    id,
+			score: highScore,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].score == result[j].score {
+			return result[i].id < result[j].id
+		} else {
+			return result[i].score > result[j].score
+		}
+	})
+	return result
+}
+
+func loadBundledStorage(tb testing.TB) *MaimaiStorage {
+	tb.Helper()
+	source := &JSONSongSource{Path: "../static/maimai/songs.json"}
+	// 只使用仓库里的别名文件
+	defer func(url string) { aliasListURL = url }(aliasListURL)
+	aliasListURL = "http://127.0.0.1:0"
+	storage, err := collectSongInfo(source, "../static/maimai/alias.json")
+	if err != nil {
+		tb.Skip("bundled songs.json not available:", err)
+	}
+	return storage
+}
+
+func Test_NormalizeKeyword(t *testing.T) {
+	for raw, want := range map[string]string{
+		"Oshama Scramble!": "oshamascramble",
+		"ＰＡＮＤＯＲＡ":          "pandora",
+		"ネコ日和。":            "ねこ日和",
+		"!!!":              "!!!",
+	} {
+		if got := normalizeKeyword(raw); got != want {
+			t.Fatalf("normalizeKeyword(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func Test_SearchIndex(t *testing.T) {
+	index := NewSearchIndex(map[int][]string{
+		1: {"系ぎて", "系统"},
+		2: {"PANDORA PARADOXXX", "潘"},
+		3: {"Oshama Scramble!"},
+		4: {"QZKago Requiem"},
+		5: {"潘多拉"},
+	})
+	for _, c := range []struct {
+		keyword string
+		want    []int
+	}{
+		{"潘", []int{2, 5, 1, 3, 4}},
+		{"oshama scramble", []int{3}},
+		{"ＱＺＫＡＧＯ", []int{4}},
+		{"pandora paradox", []int{2}},
+		{"Oshamu Scrumble", []int{3}},
+	} {
+		got := index.Search(c.keyword, len(c.want), nil)
+		for i, id := range c.want {
+			if got[i].id != id {
+				t.Fatalf("%s: got %d at %d, want %d", c.keyword, got[i].id, i, id)
+			}
+		}
+	}
+	if got := index.Search("潘", 10, nil); len(got) != 5 {
+		t.Fatalf("expected results to be capped at song count, got %d", len(got))
+	}
+}
+
+func Test_ReadingForms(t *testing.T) {
+	for norm, want := range map[string][2]string{
+		"真爱":      {"zhenai", "za"},
+		"真爱love":  {"zhenailove", "zalove"},
+		"ぼくらのうた":  {"bokuranouta", ""},
+		"しゃっきり":   {"shakkiri", ""},
+		"ふぁんたじー":  {"fantaji", ""},
+		"pandora": {"", ""},
+	} {
+		full, initials := readingForms(norm)
+		if full != want[0] || initials != want[1] {
+			t.Fatalf("readingForms(%q) = %q, %q, want %q, %q", norm, full, initials, want[0], want[1])
+		}
+	}
+}
+
+func Test_SearchIndexReadings(t *testing.T) {
+	index := NewSearchIndex(map[int][]string{
+		1: {"真爱"},
+		2: {"ボクラノウタ"},
+		3: {"za"},
+		4: {"PANDORA PARADOXXX"},
+	})
+	for keyword, want := range map[string]int{
+		"zhenai":       1,
+		"zhen ai":      1,
+		"zhena":        1,
+		"bokuranouta":  2,
+		"bokuranoutta": 2,
+		// 别名完全一致优先于拼音首字母
+		"za": 3,
+	} {
+		if got := index.Search(keyword, 1, nil)[0]; got.id != want {
+			t.Fatalf("%s: got %d, want %d", keyword, got.id, want)
+		}
+	}
+	if got := index.Search("真爱", 1, nil)[0]; got.score != scoreExact {
+		t.Fatalf("expected alias hit to keep full score, got %d", got.score)
+	}
+}
+
+func Test_Explain(t *testing.T) {
+	storage := newTestStorage()
+	storage.setAliases(mergeAliases(storage.records, storage.aliases, &Aliases{Alias: []Alias{{SongID: 1, Aliases: []string{"真爱"}}}}))
+	got := storage.Explain(PickQuery{Keyword: "zhenai"}, 2)
+	if len(got) != 2 {
+		t.Fatalf("expected 2 candidates, got %d", len(got))
+	}
+	want := SearchCandidate{Rank: 0, ID: 1, Title: "系ぎて", Score: scoreExact * 9 / 10, Match: MatchExact, Alias: "真爱", Form: "reading", Text: "zhenai"}
+	if got[0] != want {
+		t.Fatalf("got %+v, want %+v", got[0], want)
+	}
+	if got[1].Rank != 1 || got[1].ID == 1 {
+		t.Fatalf("unexpected second candidate %+v", got[1])
+	}
+	if got := storage.Explain(PickQuery{Keyword: "潘"}, 4); got[0].Alias != "潘" || got[3].Match != MatchNone || got[3].Alias != "" {
+		t.Fatalf("unexpected candidates %+v", got)
+	}
+}
+
+func Test_PickOneWrapsRank(t *testing.T) {
+	storage := newTestStorage()
+	if storage.PickOne("潘", 0).ID != 2 || storage.PickOne("潘", 4).ID != 2 {
+		t.Fatal("expected rank to wrap around song count")
+	}
+}
+
+func Test_SearchIndexAgreesWithLegacyOnAliases(t *testing.T) {
+	storage := loadBundledStorage(t)
+	checked := 0
+	for id, aliases := range storage.aliases {
+		for _, alias := range aliases {
+			got := storage.index.Search(alias, 1, nil)[0]
+			// 别名可能同时属于多首歌, 只要求命中的歌曲也有归一化后相同的别名
+			if got.id != id && !hasNormalizedAlias(storage.aliases[got.id], alias) {
+				t.Fatalf("alias %q of %d matched %d", alias, id, got.id)
+			}
+			checked++
+		}
+	}
+	if checked == 0 {
+		t.Fatal("no aliases checked")
+	}
+}
+
+func hasNormalizedAlias(aliases []string, alias string) bool {
+	for _, a := range aliases {
+		if normalizeKeyword(a) == normalizeKeyword(alias) {
+			return true
+		}
+	}
+	return false
+}
+
+var benchmarkKeywords = []string{"潘", "系统", "pandora paradoxx", "oshama", "真爱", "Future", "ぼくらの16bit戦争", "xyz 不存在"}
+
+func BenchmarkLegacyRankRecord(b *testing.B) {
+	storage := loadBundledStorage(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		legacyRankRecord(storage.aliases, benchmarkKeywords[i%len(benchmarkKeywords)])
+	}
+}
+
+func BenchmarkSearchIndex(b *testing.B) {
+	storage := loadBundledStorage(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		storage.index.Search(benchmarkKeywords[i%len(benchmarkKeywords)], 1, nil)
+	}
+}
+
+func BenchmarkNewSearchIndex(b *testing.B) {
+	storage := loadBundledStorage(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewSearchIndex(storage.aliases)
+	}
+}
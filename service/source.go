@@ -0,0 +1,390 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	SongSourcePackage    = "package"
+	SongSourceJSON       = "json"
+	SongSourceLxns       = "lxns"
+	SongSourceDivingFish = "diving-fish"
+)
+
+// SongSource 曲库来源, 返回以去掉 dx/宴 偏移后的歌曲id为键的歌曲与别名
+type SongSource interface {
+	Name() string
+	Load() (records map[int]*MaimaiRecord, aliases map[int][]string, err error)
+}
+
+// NewSongSource kind 为 package 时 path 为游戏数据目录, 多个目录以系统路径分隔符分隔, 为 json 时 path 为 songs.json,
+// 为 lxns 或 diving-fish 时 path 为接口地址, 为空时使用默认地址
+func NewSongSource(kind string, path string) (SongSource, error) {
+	switch kind {
+	case SongSourcePackage:
+		return NewPackageSongSource(path), nil
+	case SongSourceJSON:
+		return &JSONSongSource{Path: path}, nil
+	case SongSourceLxns, SongSourceDivingFish:
+		return NewRemoteSongSource(kind, path), nil
+	}
+	return nil, fmt.Errorf("unknown song source %q", kind)
+}
+
+// PackageSongSource 遍历游戏数据目录中的 Music.xml. Paths 按顺序加载, 后面的目录覆盖前面目录中同id的谱面;
+// 目录下有 A000、A001 等选项目录时同样按名称顺序加载, 选项目录中禁用的歌曲会从曲库中移除
+type PackageSongSource struct {
+	Paths []string
+
+	lock   sync.Mutex
+	report []PackageReport
+}
+
+// PackageReport 一个数据目录的加载结果, 列出的都是 Music.xml 中的歌曲id
+type PackageReport struct {
+	Path string `json:"path"`
+	// Songs 有谱面的歌曲数
+	Songs int `json:"songs"`
+	// Overridden 覆盖了前面目录中的同id歌曲
+	Overridden []int `json:"overridden,omitempty"`
+	// Removed 禁用了前面目录中的同id歌曲
+	Removed []int `json:"removed,omitempty"`
+	// Disabled 禁用的歌曲数, 包含 Removed
+	Disabled int `json:"disabled,omitempty"`
+	// Locked 需要活动解锁的歌曲
+	Locked []int `json:"locked,omitempty"`
+}
+
+func NewPackageSongSource(paths string) *PackageSongSource {
+	var roots []string
+	for _, path := range filepath.SplitList(paths) {
+		if path = strings.TrimSpace(path); path != "" {
+			roots = append(roots, path)
+		}
+	}
+	return &PackageSongSource{Paths: roots}
+}
+
+func (p *PackageSongSource) Name() string {
+	return SongSourcePackage + ":" + strings.Join(p.Paths, string(filepath.ListSeparator))
+}
+
+// optionPattern 游戏数据中的选项目录名
+var optionPattern = regexp.MustCompile(`^A\d{3}$`)
+
+// packageDirs 按加载顺序展开数据目录, 有选项目录时返回选项目录, 否则返回目录本身
+func packageDirs(root string) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() && optionPattern.MatchString(entry.Name()) {
+			dirs = append(dirs, filepath.Join(root, entry.Name()))
+		}
+	}
+	if len(dirs) == 0 {
+		return []string{root}, nil
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+func (p *PackageSongSource) Load() (map[int]*MaimaiRecord, map[int][]string, error) {
+	records := map[int]*MaimaiRecord{}
+	aliases := map[int][]string{}
+	// loaded 已加载的 Music.xml 的歌曲id
+	loaded := map[int]bool{}
+	var report []PackageReport
+	for _, root := range p.Paths {
+		dirs, err := packageDirs(root)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, dir := range dirs {
+			entry, err := loadPackageDir(dir, records, aliases, loaded)
+			if err != nil {
+				return nil, nil, err
+			}
+			log.Printf("%s: %d songs, %d overridden, %d disabled, %d removed, %d locked",
+				dir, entry.Songs, len(entry.Overridden), entry.Disabled, len(entry.Removed), len(entry.Locked))
+			report = append(report, entry)
+		}
+	}
+	p.lock.Lock()
+	p.report = report
+	p.lock.Unlock()
+	return records, aliases, nil
+}
+
+// loadPackageDir 加载一个数据目录中的 Music.xml 并覆盖到 records
+func loadPackageDir(dir string, records map[int]*MaimaiRecord, aliases map[int][]string, loaded map[int]bool) (PackageReport, error) {
+	report := PackageReport{Path: dir}
+	err := filepath.WalkDir(dir,
+		func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return fmt.Errorf("failed accessing path %q: %v", path, err)
+			}
+			if d.IsDir() || d.Name() != "Music.xml" {
+				return nil
+			}
+			fromXML, err := parseSongInfoFromXML(path)
+			if errors.Is(err, errSongDisabled) {
+				report.Disabled++
+				if loaded[fromXML.ID] {
+					removeRecord(records, aliases, fromXML.ID)
+					delete(loaded, fromXML.ID)
+					report.Removed = append(report.Removed, fromXML.ID)
+				}
+				return nil
+			}
+			if err != nil {
+				log.Printf("error parsing song info from %s: %v\n", path, err)
+				return err
+			}
+			if len(fromXML.Levels) == 0 {
+				return nil
+			}
+			report.Songs++
+			if fromXML.Locked {
+				report.Locked = append(report.Locked, fromXML.ID)
+			}
+			if loaded[fromXML.ID] {
+				report.Overridden = append(report.Overridden, fromXML.ID)
+			}
+			loaded[fromXML.ID] = true
+			addRecord(records, aliases, fromXML)
+			return nil
+		})
+	return report, err
+}
+
+// Report 最近一次加载各数据目录的结果
+func (p *PackageSongSource) Report() []PackageReport {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]PackageReport(nil), p.report...)
+}
+
+// JSONSongSource 读取 static/maimai/songs.json 格式的曲库
+type JSONSongSource struct {
+	Path string
+}
+
+type jsonSong struct {
+	Title    string        `json:"title"`
+	Alias    []string      `json:"alias"`
+	Image    string        `json:"image"`
+	Category string        `json:"category"`
+	Levels   []MaimaiLevel `json:"levels"`
+}
+
+// difficultyOrder 谱面难度由低到高, GetTrack* 依赖该顺序
+var difficultyOrder = map[string]int{
+	"bas":   0,
+	"adv":   1,
+	"exp":   2,
+	"mas":   3,
+	"remas": 4,
+}
+
+func (j *JSONSongSource) Name() string {
+	return SongSourceJSON + ":" + j.Path
+}
+
+func (j *JSONSongSource) Load() (map[int]*MaimaiRecord, map[int][]string, error) {
+	content, err := os.ReadFile(j.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var songs map[string]*jsonSong
+	if err = json.Unmarshal(content, &songs); err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]int, 0, len(songs))
+	byID := map[int]*jsonSong{}
+	for key, song := range songs {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid song id %q: %v", key, err)
+		}
+		ids = append(ids, id)
+		byID[id] = song
+	}
+	sort.Ints(ids)
+
+	records := map[int]*MaimaiRecord{}
+	aliases := map[int][]string{}
+	skipped := 0
+	for _, id := range ids {
+		song := byID[id]
+		levels := normalizeLevels(song.Levels)
+		if len(levels) == 0 {
+			skipped++
+			continue
+		}
+		addRecord(records, aliases, &MaimaiRecord{
+			ID:        id,
+			Title:     song.Title,
+			ImagePath: coverPath(normalizeSongID(id)),
+			Levels:    levels,
+			Category:  song.Category,
+		}, song.Alias...)
+	}
+	if skipped > 0 {
+		log.Printf("%d songs in %s have no levels, skipped", skipped, j.Path)
+	}
+	return records, aliases, nil
+}
+
+// normalizeSongID 去掉 dx 谱面的 10000 与宴会场的 100000 偏移, 用于封面
+func normalizeSongID(id int) int {
+	if id >= 100000 {
+		return id - 100000
+	}
+	if id >= 10000 {
+		return id - 10000
+	}
+	return id
+}
+
+// songKey 曲库中歌曲的键, 标准与 dx 谱面去掉 10000 偏移后是同一首歌;
+// 宴会场去掉 100000 偏移后不一定是同一首歌, 保留原id
+func songKey(id int) int {
+	if id >= 100000 {
+		return id
+	}
+	return normalizeSongID(id)
+}
+
+// chartTypeOf 游戏数据中歌曲id对应的谱面类型
+func chartTypeOf(id int) string {
+	switch {
+	case id >= 100000:
+		return "宴"
+	case id >= 10000:
+		return "dx"
+	}
+	return "std"
+}
+
+// chartTypeOrder 同一首歌的谱面按 标准、dx、宴 排列, 默认选中最后一组中最难的谱面
+var chartTypeOrder = map[string]int{
+	"std": 0,
+	"dx":  1,
+	"宴":   2,
+}
+
+// addRecord 把一组谱面并入曲库: 同一首歌的各类谱面合并为一条, 歌曲信息以 dx 为准;
+// 已有同类谱面时整组替换, 因此后加入的来源优先
+func addRecord(records map[int]*MaimaiRecord, aliases map[int][]string, record *MaimaiRecord, songAliases ...string) {
+	key := songKey(record.ID)
+	aliases[key] = uniqueAliases(append(append(aliases[key], record.Title), songAliases...))
+	existing, ok := records[key]
+	if !ok {
+		record.Levels = normalizeLevels(record.Levels)
+		records[key] = record
+		return
+	}
+	replaced := map[string]bool{}
+	for _, level := range record.Levels {
+		replaced[level.Type] = true
+	}
+	levels := append([]MaimaiLevel(nil), record.Levels...)
+	for _, level := range existing.Levels {
+		if !replaced[level.Type] {
+			levels = append(levels, level)
+		}
+	}
+	primary := record
+	if existing.hasChartType("dx") && !record.hasChartType("dx") {
+		primary = existing
+	}
+	merged := *primary
+	merged.Levels = normalizeLevels(levels)
+	records[key] = &merged
+}
+
+// removeRecord 从曲库中移除歌曲id对应的一组谱面, 没有剩余谱面时移除整首歌
+func removeRecord(records map[int]*MaimaiRecord, aliases map[int][]string, id int) {
+	key := songKey(id)
+	existing, ok := records[key]
+	if !ok {
+		return
+	}
+	noteType := chartTypeOf(id)
+	var levels []MaimaiLevel
+	for _, level := range existing.Levels {
+		if level.Type != noteType {
+			levels = append(levels, level)
+		}
+	}
+	if len(levels) == 0 {
+		delete(records, key)
+		delete(aliases, key)
+		return
+	}
+	remaining := *existing
+	remaining.Levels = levels
+	records[key] = &remaining
+}
+
+// normalizeLevels songs.json 中 difficulty 与 level 字段是反的, 两种写法都接受, 并按谱面类型与难度排序
+func normalizeLevels(levels []MaimaiLevel) []MaimaiLevel {
+	result := make([]MaimaiLevel, 0, len(levels))
+	for _, level := range levels {
+		_, difficultyOK := difficultyOrder[level.Difficulty]
+		if _, swapped := difficultyOrder[level.Level]; swapped && !difficultyOK {
+			level.Difficulty, level.Level = level.Level, level.Difficulty
+		}
+		result = append(result, level)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if a, b := chartTypeRank(result[i].Type), chartTypeRank(result[j].Type); a != b {
+			return a < b
+		}
+		a, ok := difficultyOrder[result[i].Difficulty]
+		if !ok {
+			a = len(difficultyOrder)
+		}
+		b, ok := difficultyOrder[result[j].Difficulty]
+		if !ok {
+			b = len(difficultyOrder)
+		}
+		return a < b
+	})
+	return result
+}
+
+func chartTypeRank(chartType string) int {
+	if rank, ok := chartTypeOrder[chartType]; ok {
+		return rank
+	}
+	return len(chartTypeOrder)
+}
+
+func uniqueAliases(aliases []string) []string {
+	seen := map[string]bool{}
+	result := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		if alias == "" || seen[alias] {
+			continue
+		}
+		seen[alias] = true
+		result = append(result, alias)
+	}
+	return result
+}
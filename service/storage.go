@@ -1,12 +1,12 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
-	fuzz "github.com/paul-mannino/go-fuzzywuzzy"
 	"io"
-	"io/fs"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -15,22 +15,35 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type MaimaiStorage struct {
-	filePath string
-	records  map[int]*MaimaiRecord
-	aliases  map[int][]string
-}
+	source    SongSource
+	aliasPath string
+	records   map[int]*MaimaiRecord
+	// sourceAliases 曲库自带的别名, 刷新别名时保留
+	sourceAliases map[int][]string
 
-type item struct {
-	score int
-	id    int
+	lock    sync.RWMutex
+	aliases map[int][]string
+	index   *SearchIndex
+	// remote 在线或别名文件中的别名, overlay 观众提交并通过审核的别名, 刷新在线别名时保留
+	remote  *Aliases
+	overlay *Aliases
+	// allowUtage 宴会场歌曲是否可以点
+	allowUtage bool
+	// allowLocked 需要活动解锁的歌曲是否可以点
+	allowLocked bool
 }
 
 func coverPath(id int) string {
 	return "https://assets2.lxns.net/maimai/jacket/" + strconv.Itoa(id) + ".png"
 }
+
+var errSongDisabled = errors.New("song disabled")
+
 func parseSongInfoFromXML(path string) (*MaimaiRecord, error) {
 	var music MusicData
 	xmlFile, err := os.Open(path)
@@ -47,20 +60,14 @@ func parseSongInfoFromXML(path string) (*MaimaiRecord, error) {
 	if err = xml.Unmarshal(data, &music); err != nil {
 		return nil, err
 	}
+	if music.Disable {
+		// 禁用时只返回id与标题, 用于从曲库中移除
+		return &MaimaiRecord{ID: music.Name.ID, Title: music.Name.Str}, errSongDisabled
+	}
 
 	musicID := music.Name.ID
-	coverUrl := ""
-	noteType := ""
-	if musicID >= 10000 && musicID < 100000 {
-		noteType = "dx"
-		coverUrl = coverPath(musicID - 10000)
-	} else if musicID >= 100000 {
-		noteType = "宴"
-		coverUrl = coverPath(musicID - 100000)
-	} else {
-		noteType = "std"
-		coverUrl = coverPath(musicID)
-	}
+	coverUrl := coverPath(normalizeSongID(musicID))
+	noteType := chartTypeOf(musicID)
 	var levels []MaimaiLevel
 	difficulties := []string{"bas", "adv", "exp", "mas", "remas"}
 	for i, note := range music.NotesData.Notes {
@@ -69,6 +76,9 @@ func parseSongInfoFromXML(path string) (*MaimaiRecord, error) {
 				Type:       noteType,
 				Difficulty: difficulties[i],
 				Level:      strconv.Itoa(note.Level) + "." + strconv.Itoa(note.LevelDecimal),
+				Constant:   float64(note.Level) + float64(note.LevelDecimal)/10,
+				Charter:    designerName(note.NotesDesigner.Str),
+				Notes:      note.MaxNotes,
 			})
 		}
 	}
@@ -78,6 +88,11 @@ func parseSongInfoFromXML(path string) (*MaimaiRecord, error) {
 		ImagePath: coverUrl,
 		Levels:    levels,
 		Category:  music.GenreName.Str,
+		Artist:    music.ArtistName.Str,
+		BPM:       music.BPM,
+		Version:   music.AddVersion.Str,
+		Locked:    music.LockType != 0,
+		Jacket:    music.JacketFile,
 	}
 
 	if genre, ok := genreMapping[music.GenreName.Str]; ok {
@@ -89,6 +104,14 @@ func parseSongInfoFromXML(path string) (*MaimaiRecord, error) {
 	return result, nil
 }
 
+// designerName 没有署名的谱面作者为 "-"
+func designerName(name string) string {
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
 var genreMapping = map[string]string{
 	"ゲームバラエティ":     "其他游戏",
 	"maimai":               "舞萌",
@@ -99,8 +122,9 @@ var genreMapping = map[string]string{
 	"宴会場":               "宴会場",
 }
 
+// collectAlias 优先在线获取别名并写回别名文件, 失败时读取别名文件
 func collectAlias(aliasPath string) (*Aliases, error) {
-	tryFetch, err := fetchAliasList()
+	tryFetch, err := fetchAndSaveAlias(aliasPath)
 	if err != nil {
 		log.Printf("Failed to fetch aliases %v\n", err)
 	} else {
@@ -127,119 +151,312 @@ func collectAlias(aliasPath string) (*Aliases, error) {
 	return &aliases, nil
 }
 
-func collectSongInfoFromPackage(path string, aliasPath string) (*MaimaiStorage, error) {
-
-	aliases, err := collectAlias(aliasPath)
+// fetchAndSaveAlias 在线获取别名并写回别名文件, 写回失败只记录日志
+func fetchAndSaveAlias(aliasPath string) (*Aliases, error) {
+	list, err := fetchAliasList()
 	if err != nil {
 		return nil, err
 	}
-	storage := &MaimaiStorage{
-		filePath: path,
-		records:  map[int]*MaimaiRecord{},
-		aliases:  map[int][]string{},
+	if aliasPath != "" {
+		if err = saveAlias(aliasPath, list); err != nil {
+			log.Printf("Failed to save aliases to %s %v\n", aliasPath, err)
+		}
 	}
+	return list, nil
+}
 
-	err = filepath.WalkDir(path,
-		func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				log.Fatalf("prevent panic by handling failure accessing a path %q: %v\n", path, err)
-				return err
-			}
-			if d.IsDir() == false && d.Name() == "Music.xml" {
-				fromXML, err := parseSongInfoFromXML(path)
-				if err != nil {
-					log.Printf("error parsing song info from %s: %v\n", path, err)
-					return err
-				}
-				targetID := fromXML.ID
-				if fromXML.ID >= 10000 && fromXML.ID < 20000 {
-					targetID = fromXML.ID - 10000
-				} else if fromXML.ID > 100000 {
-					targetID = fromXML.ID - 100000
-				} else {
-					targetID = fromXML.ID
-				}
-				storage.records[targetID] = fromXML
-				if _, ok := storage.aliases[targetID]; !ok {
-					storage.aliases[targetID] = []string{fromXML.Title}
-				}
-			}
-			//	log.Printf("visited file or dir: %q\n", path)
-			return nil
-		})
-
-	for _, alias := range aliases.Alias {
-		if _, ok := storage.records[alias.SongID]; ok {
-			if _, ok2 := storage.aliases[alias.SongID]; !ok2 {
-				storage.aliases[alias.SongID] = alias.Aliases
-			} else {
-				storage.aliases[alias.SongID] = append(storage.aliases[alias.SongID], alias.Aliases...)
+func saveAlias(aliasPath string, aliases *Aliases) error {
+	content, err := json.MarshalIndent(aliases, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(aliasPath, content)
+}
+
+// writeFileAtomic 先写入同目录的临时文件再重命名, 避免中途退出留下不完整的文件
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// mergeAliases 曲库自带的别名在前, 只保留曲库中存在的歌曲
+func mergeAliases(records map[int]*MaimaiRecord, base map[int][]string, lists ...*Aliases) map[int][]string {
+	result := make(map[int][]string, len(base))
+	for id, aliases := range base {
+		result[id] = append([]string(nil), aliases...)
+	}
+	for _, list := range lists {
+		if list == nil {
+			continue
+		}
+		for _, alias := range list.Alias {
+			if _, ok := records[alias.SongID]; ok {
+				result[alias.SongID] = append(result[alias.SongID], alias.Aliases...)
 			}
 		}
 	}
-	log.Println("Songs found:", len(storage.aliases), "records:", len(storage.records))
+	return result
+}
+
+func collectSongInfo(source SongSource, aliasPath string) (*MaimaiStorage, error) {
+
+	aliases, err := collectAlias(aliasPath)
+	if err != nil {
+		return nil, err
+	}
+	records, sourceAliases, err := source.Load()
+	if err != nil {
+		return nil, err
+	}
+	storage := &MaimaiStorage{
+		source:        source,
+		aliasPath:     aliasPath,
+		records:       records,
+		sourceAliases: sourceAliases,
+		remote:        aliases,
+	}
+	storage.setAliases(mergeAliases(records, sourceAliases, aliases))
+	log.Println("Songs found:", len(storage.aliases), "records:", len(storage.records), "from", source.Name())
 	return storage, nil
 }
 
-func NewMaimaiStorage(filePath string, aliasPath string) *MaimaiStorage {
-	fromPackage, err := collectSongInfoFromPackage(filePath, aliasPath)
+func NewMaimaiStorage(source SongSource, aliasPath string) *MaimaiStorage {
+	storage, err := collectSongInfo(source, aliasPath)
 	if err != nil {
 		panic(err)
 	}
-	return fromPackage
+	return storage
 }
 
-func (s *MaimaiStorage) PickOne(keyword string, rank int) *MaimaiRecord {
-	rankList := s.rankRecord(keyword)
-	return s.records[rankList[rank%len(rankList)].id]
+// RefreshAliases 重新获取在线别名并替换, 不影响正在进行的匹配; 获取失败时保留现有别名
+func (s *MaimaiStorage) RefreshAliases() error {
+	list, err := fetchAndSaveAlias(s.aliasPath)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.remote = list
+	s.setAliases(mergeAliases(s.records, s.sourceAliases, s.remote, s.overlay))
+	s.lock.Unlock()
+	log.Println("Aliases refreshed:", len(list.Alias))
+	return nil
 }
 
-func (s *MaimaiStorage) rankRecord(keyword string) []*item {
+// SetOverlay 替换本地审核通过的别名, 保存副本, 调用方之后仍可以修改 overlay
+func (s *MaimaiStorage) SetOverlay(overlay *Aliases) {
+	overlay = overlay.clone()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.overlay = overlay
+	s.setAliases(mergeAliases(s.records, s.sourceAliases, s.remote, s.overlay))
+}
 
-	var result = make([]*item, 0, len(s.records))
+// FindSong 按歌曲id、完整标题或已有别名查找歌曲, 不做模糊匹配
+func (s *MaimaiStorage) FindSong(target string) (*MaimaiRecord, bool) {
+	target = strings.TrimSpace(target)
+	if id, err := strconv.Atoi(target); err == nil {
+		record, ok := s.records[songKey(id)]
+		if ok {
+			return record, true
+		}
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	// 同一别名对应多首歌时优先完整标题, 其次取id最小的
+	found := -1
 	for id, aliases := range s.aliases {
-		highScore := -1
-		if id == 1681 {
-			highScore = -1
+		record := s.records[id]
+		if record == nil {
+			continue
+		}
+		if strings.EqualFold(record.Title, target) {
+			return record, true
 		}
 		for _, alias := range aliases {
-			score := fuzz.UQRatio(alias, keyword)
-			if strings.ToLower(alias) == strings.ToLower(keyword) {
-				score++
-			}
-			if score > highScore {
-				highScore = score
+			if strings.EqualFold(alias, target) && (found == -1 || id < found) {
+				found = id
 			}
 		}
-		result = append(result, &item{
-			id:    id,
-			score: highScore,
-		})
 	}
+	if found == -1 {
+		return nil, false
+	}
+	return s.records[found], true
+}
+
+// Record 按曲库中的键查找歌曲, 标准与 dx 谱面为去掉 10000 偏移后的id
+func (s *MaimaiStorage) Record(key int) (*MaimaiRecord, bool) {
+	record, ok := s.records[key]
+	return record, ok
+}
+
+// HasAlias 歌曲是否已有该别名
+func (s *MaimaiStorage) HasAlias(songID int, alias string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, existing := range s.aliases[songKey(songID)] {
+		if strings.EqualFold(existing, alias) {
+			return true
+		}
+	}
+	return false
+}
 
-	sort.Slice(result, func(i, j int) bool {
-		if result[i].score == result[j].score {
-			return result[i].id < result[j].id
-		} else {
-			return result[i].score > result[j].score
+// WatchAliases 每隔 interval 刷新一次别名, 直到 ctx 取消
+func (s *MaimaiStorage) WatchAliases(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.RefreshAliases(); err != nil {
+			log.Printf("Failed to refresh aliases %v\n", err)
 		}
-	})
-	for i, r := range result {
-		fmt.Println(r.score, r.id, s.records[r.id].Title)
-		if i > 20 {
-			break
+	}
+}
+
+// searchFor 返回当前索引、条件过滤函数与满足条件的歌曲数
+func (s *MaimaiStorage) searchFor(query PickQuery) (*SearchIndex, func(id int) bool, int) {
+	s.lock.RLock()
+	index := s.index
+	allowUtage, allowLocked := s.allowUtage, s.allowLocked
+	s.lock.RUnlock()
+	if !query.HasFilter() && allowUtage && allowLocked {
+		return index, nil, index.Len()
+	}
+	filter := func(id int) bool {
+		record := s.records[id]
+		return (allowUtage || !record.IsUtage()) && (allowLocked || !record.Locked) && query.Match(record)
+	}
+	count := 0
+	for _, id := range index.ids {
+		if filter(id) {
+			count++
 		}
 	}
+	return index, filter, count
+}
+
+// SourceReport 曲库来源的名称, 来源是游戏数据目录时同时返回各目录的加载结果
+func (s *MaimaiStorage) SourceReport() (string, []PackageReport) {
+	if source, ok := s.source.(*PackageSongSource); ok {
+		return source.Name(), source.Report()
+	}
+	return s.source.Name(), nil
+}
+
+// SetAllowUtage 设置宴会场歌曲是否可以点, 不可以时点歌与查歌都跳过宴会场歌曲
+func (s *MaimaiStorage) SetAllowUtage(allow bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.allowUtage = allow
+}
+
+// SetAllowLocked 设置需要活动解锁的歌曲是否可以点, 不可以时点歌与查歌都跳过这些歌曲
+func (s *MaimaiStorage) SetAllowLocked(allow bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.allowLocked = allow
+}
+
+// Explain 返回满足条件的前 n 个匹配结果及命中的别名, 即换歌时依次会换到的歌曲
+func (s *MaimaiStorage) Explain(query PickQuery, n int) []SearchCandidate {
+	index, filter, _ := s.searchFor(query)
+	result := make([]SearchCandidate, 0, n)
+	for rank, i := range index.Search(query.Keyword, n, filter) {
+		candidate := index.explain(i)
+		candidate.Rank = rank
+		candidate.Title = s.records[i.id].Title
+		result = append(result, candidate)
+	}
+	return result
+}
+
+// Pick 返回满足条件的第 rank 个匹配结果, rank 超过满足条件的歌曲数时从头开始
+func (s *MaimaiStorage) Pick(query PickQuery, rank int) (*MaimaiRecord, error) {
+	index, filter, count := s.searchFor(query)
+	if count == 0 {
+		return nil, fmt.Errorf("没有符合 %s 的谱面", query)
+	}
+	rank %= count
+	rankList := index.Search(query.Keyword, rank+1, filter)
+	return s.records[rankList[rank].id], nil
+}
 
+// Categories 曲库中的歌曲分类
+func (s *MaimaiStorage) Categories() []string {
+	seen := map[string]bool{}
+	result := make([]string, 0)
+	for _, record := range s.records {
+		if record.Category != "" && !seen[record.Category] {
+			seen[record.Category] = true
+			result = append(result, record.Category)
+		}
+	}
+	sort.Strings(result)
 	return result
 }
 
+// RandomPick 在满足条件且没有被 exclude 排除的歌曲中随机选一首, intn 返回 [0, n) 的随机数
+func (s *MaimaiStorage) RandomPick(query PickQuery, exclude func(record *MaimaiRecord) bool, intn func(n int) int) (*MaimaiRecord, error) {
+	index, filter, _ := s.searchFor(query)
+	var candidates []*MaimaiRecord
+	for _, id := range index.ids {
+		if filter != nil && !filter(id) {
+			continue
+		}
+		if record := s.records[id]; exclude == nil || !exclude(record) {
+			candidates = append(candidates, record)
+		}
+	}
+	if len(candidates) == 0 {
+		if query.HasFilter() {
+			return nil, fmt.Errorf("没有符合 %s 的歌曲可以随机了", query)
+		}
+		return nil, errors.New("没有可以随机的歌曲了")
+	}
+	return candidates[intn(len(candidates))], nil
+}
+
+// PickOne 按关键词返回第 rank 个匹配结果, rank 超过歌曲数时从头开始
+func (s *MaimaiStorage) PickOne(keyword string, rank int) *MaimaiRecord {
+	record, _ := s.Pick(PickQuery{Keyword: keyword}, rank)
+	return record
+}
+
+// setAliases 替换别名并重建索引, 调用方需持有写锁
+func (s *MaimaiStorage) setAliases(aliases map[int][]string) {
+	s.aliases = aliases
+	s.index = NewSearchIndex(aliases)
+}
+
+// aliasListURL 在线别名列表, 测试时可替换
+var aliasListURL = "https://maimai.lxns.net/api/v0/maimai/alias/list"
+
 func fetchAliasList() (*Aliases, error) {
 
-	url := "https://maimai.lxns.net/api/v0/maimai/alias/list"
+	url := aliasListURL
 	method := "GET"
 
-	client := &http.Client{}
+	client := &http.Client{Timeout: 30 * time.Second}
 	req, err := http.NewRequest(method, url, nil)
 
 	if err != nil {
@@ -251,6 +468,9 @@ func fetchAliasList() (*Aliases, error) {
 		return nil, err
 	}
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
@@ -261,5 +481,8 @@ func fetchAliasList() (*Aliases, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(aliases.Alias) == 0 {
+		return nil, fmt.Errorf("empty alias list")
+	}
 	return aliases, nil
 }
@@ -2,14 +2,267 @@ package service
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 )
 
 func Test_WalkPackages(t *testing.T) {
 	testPath := "/Users/bytedance/Downloads/Package/"
-	fromPackage, err := collectSongInfoFromPackage(testPath)
+	if _, err := os.Stat(testPath); err != nil {
+		t.Skip("song package not found:", testPath)
+	}
+	fromPackage, err := collectSongInfo(NewPackageSongSource(testPath), "")
 	if err != nil {
 		return
 	}
 	fmt.Println(fromPackage)
 }
+
+func Test_ParseSongInfoFromXML(t *testing.T) {
+	record, err := parseSongInfoFromXML("testdata/package/A000/music/music010834/Music.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Artist != "削除" || record.BPM != 150 || record.Version != "maimai FiNALE" || record.Category != "舞萌" ||
+		record.Jacket != "UI_Jacket_000834" {
+		t.Fatalf("unexpected record %+v", record)
+	}
+	if len(record.Levels) != 5 {
+		t.Fatalf("expected empty charts to be skipped, got %d", len(record.Levels))
+	}
+	if got := record.Levels[3]; got.Charter != "サファ太 vs -ZONE- SaFaRi" || got.Notes != 1228 || got.Constant != 14.8 {
+		t.Fatalf("unexpected master chart %+v", got)
+	}
+	if record.Levels[0].Charter != "" {
+		t.Fatalf("expected unsigned charter to be empty, got %q", record.Levels[0].Charter)
+	}
+
+	ticket := &MaimaiTicket{Record: record, Level: 1}
+	if ticket.GetCharter() != "サファ太 vs -ZONE- SaFaRi" || ticket.GetNotes() != 1228 || ticket.GetBPM() != 150 {
+		t.Fatalf("unexpected ticket info %s %d %d", ticket.GetCharter(), ticket.GetNotes(), ticket.GetBPM())
+	}
+}
+
+func Test_PackageSongSourceMergesCharts(t *testing.T) {
+	records, _, err := NewPackageSongSource("testdata/package/A000").Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected disabled song to be skipped and std/dx merged, got %d records", len(records))
+	}
+	record := records[834]
+	if record.Version != "maimai FiNALE" || len(record.Levels) != 7 {
+		t.Fatalf("unexpected merged record %+v", record)
+	}
+	if record.Levels[1].Type != "std" || record.Levels[1].Constant != 14.9 || record.GetTrackType(0) != "dx" {
+		t.Fatalf("expected std charts before dx charts, got %+v", record.Levels)
+	}
+}
+
+func Test_PackageSongSourceOverlays(t *testing.T) {
+	source := NewPackageSongSource("testdata/package" + string(filepath.ListSeparator) + "testdata/extra")
+	records, aliases, err := source.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[1000].Title != "Extra Song" || records[1000].Locked || !records[1001].Locked {
+		t.Fatalf("expected songs from both roots, got %v", records)
+	}
+	// A001 禁用了标准谱面并覆盖了 dx 谱面
+	record := records[834]
+	if len(record.Levels) != 4 || record.GetTrackType(0) != "dx" || record.Levels[3].Constant != 14.9 {
+		t.Fatalf("expected A001 to override A000, got %+v", record.Levels)
+	}
+	if len(aliases[834]) == 0 {
+		t.Fatal("expected aliases of overridden song to be kept")
+	}
+
+	report := source.Report()
+	if len(report) != 3 || report[0].Path != filepath.Join("testdata", "package", "A000") || report[2].Path != "testdata/extra" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if got := report[1]; got.Songs != 1 || got.Disabled != 1 || len(got.Overridden) != 1 || got.Overridden[0] != 10834 ||
+		len(got.Removed) != 1 || got.Removed[0] != 834 {
+		t.Fatalf("unexpected A001 report %+v", got)
+	}
+	if got := report[2].Locked; len(got) != 1 || got[0] != 11001 {
+		t.Fatalf("expected locked song in report, got %v", got)
+	}
+}
+
+func Test_LockedPicksAreGated(t *testing.T) {
+	locked, err := parseSongInfoFromXML("testdata/extra/music/music011001/Music.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := newTestStorage()
+	storage.records[1001] = locked
+	storage.aliases[1001] = []string{locked.Title}
+	storage.setAliases(storage.aliases)
+
+	if record, err := storage.Pick(PickQuery{Keyword: "Locked Song"}, 0); err != nil || record.Locked {
+		t.Fatalf("expected locked song to be skipped, got %+v %v", record, err)
+	}
+	storage.SetAllowLocked(true)
+	if record, err := storage.Pick(PickQuery{Keyword: "Locked Song"}, 0); err != nil || record.ID != 11001 {
+		t.Fatalf("expected locked song to be picked, got %+v %v", record, err)
+	}
+}
+
+func Test_UtagePicksAreGated(t *testing.T) {
+	storage := newTestStorage()
+	storage.records[100002] = &MaimaiRecord{
+		ID:     100002,
+		Title:  "[協]PANDORA PARADOXXX",
+		Levels: []MaimaiLevel{{Type: "宴", Difficulty: "bas", Level: "14?"}},
+	}
+	storage.aliases[100002] = []string{"[協]PANDORA PARADOXXX"}
+	storage.setAliases(storage.aliases)
+
+	// 默认不能点宴会场歌曲
+	if record, err := storage.Pick(PickQuery{Keyword: "[協]PANDORA"}, 0); err != nil || record.IsUtage() {
+		t.Fatalf("expected utage song to be skipped, got %+v %v", record, err)
+	}
+	if _, err := storage.Pick(PickQuery{Keyword: "pandora", Type: "宴"}, 0); err == nil {
+		t.Fatal("expected no requestable utage chart")
+	}
+	storage.SetAllowUtage(true)
+	if record, err := storage.Pick(PickQuery{Keyword: "pandora", Type: "宴"}, 0); err != nil || record.ID != 100002 {
+		t.Fatalf("expected utage song to be picked, got %+v %v", record, err)
+	}
+	if candidates := storage.Explain(PickQuery{Keyword: "[協]PANDORA"}, 1); len(candidates) == 0 || candidates[0].ID != 100002 {
+		t.Fatalf("expected utage song to be searchable, got %+v", candidates)
+	}
+}
+
+func Test_JSONSongSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "songs.json")
+	content := `{
+		"8": {"title": "True Love Song", "alias": ["真爱", "真爱"], "category": "舞萌", "levels": [
+			{"type": "std", "difficulty": "12", "level": "mas"},
+			{"type": "std", "difficulty": "5", "level": "bas"},
+			{"type": "std", "difficulty": "adv", "level": "7"}]},
+		"30": {"title": "ネコ日和。", "category": "舞萌", "levels": [{"type": "std", "difficulty": "9", "level": "exp"}]},
+		"10030": {"title": "ネコ日和。", "category": "舞萌", "levels": []}
+	}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	records, aliases, err := (&JSONSongSource{Path: path}).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[30].ID != 30 {
+		t.Fatalf("expected songs without levels to be skipped, got %v", records)
+	}
+	record := records[8]
+	if got := record.GetTrackDifficulty(0) + " " + record.GetTrackLevel(0); got != "mas 12" {
+		t.Fatalf("expected hardest chart first, got %s", got)
+	}
+	if got := record.Levels[1]; got.Difficulty != "adv" || got.Level != "7" {
+		t.Fatalf("expected both field orders to be accepted, got %+v", got)
+	}
+	if strings.Join(aliases[8], ",") != "True Love Song,真爱" {
+		t.Fatalf("unexpected aliases %v", aliases[8])
+	}
+}
+
+func Test_BundledSongsJSON(t *testing.T) {
+	records, _, err := (&JSONSongSource{Path: "../static/maimai/songs.json"}).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) < 1000 {
+		t.Fatalf("expected bundled songs to be loaded, got %d", len(records))
+	}
+}
+
+func Test_AliasesArePersistedAndRefreshed(t *testing.T) {
+	var body atomic.Value
+	body.Store(`{"aliases": [{"song_id": 1, "aliases": ["系统"]}]}`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body.Load().(string)))
+	}))
+	defer server.Close()
+	defer func(url string) { aliasListURL = url }(aliasListURL)
+	aliasListURL = server.URL
+
+	aliasPath := filepath.Join(t.TempDir(), "alias.json")
+	source := &staticSongSource{records: newTestStorage().records}
+	storage, err := collectSongInfo(source, aliasPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.PickOne("系统", 0).ID != 1 {
+		t.Fatal("expected fetched alias to be used")
+	}
+
+	// 刷新后替换别名, 曲库自带的标题仍然保留
+	body.Store(`{"aliases": [{"song_id": 2, "aliases": ["系统"]}, {"song_id": 99, "aliases": ["不存在"]}]}`)
+	if err = storage.RefreshAliases(); err != nil {
+		t.Fatal(err)
+	}
+	if storage.PickOne("系统", 0).ID != 2 || storage.PickOne("系ぎて", 0).ID != 1 {
+		t.Fatal("expected refreshed aliases to be used")
+	}
+
+	// 离线启动时使用写回的别名文件
+	server.Close()
+	storage, err = collectSongInfo(source, aliasPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage.PickOne("系统", 0).ID != 2 {
+		t.Fatal("expected aliases from the saved file")
+	}
+	if _, ok := storage.aliases[99]; ok {
+		t.Fatal("expected aliases of unknown songs to be dropped")
+	}
+}
+
+func Test_OfflineRefreshKeepsAliases(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"aliases": [{"song_id": 2, "aliases": ["潘多拉"]}]}`))
+	}))
+	defer func(url string) { aliasListURL = url }(aliasListURL)
+	aliasListURL = server.URL
+
+	// 没有别名文件
+	storage, err := collectSongInfo(&staticSongSource{records: newTestStorage().records}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !storage.HasAlias(2, "潘多拉") {
+		t.Fatal("expected fetched alias")
+	}
+	server.Close()
+	if err = storage.RefreshAliases(); err == nil {
+		t.Fatal("expected refresh to fail offline")
+	}
+	if !storage.HasAlias(2, "潘多拉") || storage.PickOne("潘多拉", 0).ID != 2 {
+		t.Fatal("expected aliases to be kept after a failed refresh")
+	}
+}
+
+// staticSongSource 测试用的固定曲库
+type staticSongSource struct {
+	records map[int]*MaimaiRecord
+}
+
+func (s *staticSongSource) Name() string {
+	return "static"
+}
+
+func (s *staticSongSource) Load() (map[int]*MaimaiRecord, map[int][]string, error) {
+	aliases := map[int][]string{}
+	for id, record := range s.records {
+		aliases[id] = []string{record.Title}
+	}
+	return s.records, aliases, nil
+}